@@ -0,0 +1,50 @@
+package loopback
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// LoopHandle is a loop device attached with autoclear. The handle keeps the device open and the kernel
+// frees it as soon as the last opener closes it, so the device goes away even if the process is killed.
+type LoopHandle struct {
+	file *os.File
+	log  Logger
+
+	once sync.Once
+	err  error
+}
+
+// LoopAutoclear attaches the image to a free loop device with LO_FLAGS_AUTOCLEAR set and returns a handle owning
+// an open fd on it. Closing the handle (or the process exiting) releases the device once nothing else holds it,
+// mappings and mounts on top of it keep it alive until they are removed.
+func LoopAutoclear(ctx context.Context, img string, opts LoopOptions, log Logger) (*LoopHandle, error) {
+	loopFile, err := attach(ctx, img, opts, unix.LO_FLAGS_AUTOCLEAR, log)
+	if err != nil {
+		return nil, err
+	}
+	return &LoopHandle{file: loopFile, log: log}, nil
+}
+
+// Path returns the loop device path, like /dev/loop0
+func (h *LoopHandle) Path() string {
+	return h.file.Name()
+}
+
+// File returns the open loop device, it must not be closed directly
+func (h *LoopHandle) File() *os.File {
+	return h.file
+}
+
+// Close drops the handle's reference to the loop device, letting the kernel free it. Calling it again is a no-op.
+func (h *LoopHandle) Close() error {
+	h.once.Do(func() {
+		h.log.Printf("Releasing autoclear loop device %s", h.file.Name())
+		h.err = h.file.Close()
+		journalRemove(journalKindLoop, h.file.Name(), h.log)
+	})
+	return h.err
+}
@@ -0,0 +1,200 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CleanupOptions controls how CleanupMappingsForDeviceWithOptions deals with busy mappings
+type CleanupOptions struct {
+	// Retries is how many more times a busy mapping removal is attempted
+	Retries int
+	// Backoff is the wait before the first retry, doubled after each attempt. Defaults to 100ms.
+	Backoff time.Duration
+	// DeferredRemove flags mappings that are still busy after the retries for deferred removal,
+	// so the kernel removes them once their last opener closes them
+	DeferredRemove bool
+}
+
+// Process is a process holding a device open
+type Process struct {
+	PID     int
+	Command string
+}
+
+// BusyMapping is a mapping that could not be removed and the processes that hold it open
+type BusyMapping struct {
+	Name      string
+	Processes []Process
+}
+
+// CleanupReport describes what CleanupMappingsForDeviceWithOptions did with each mapping
+type CleanupReport struct {
+	Removed  []string
+	Deferred []string
+	Busy     []BusyMapping
+}
+
+// CleanupMappingsForDeviceWithOptions removes the mappings of a loop device, retrying busy ones with backoff and
+// optionally falling back to deferred removal. The report lists every mapping that is still there with the
+// processes holding it, in which case an error is returned as well.
+func CleanupMappingsForDeviceWithOptions(ctx context.Context, loopDevice string, opts CleanupOptions, log Logger) (*CleanupReport, error) {
+	names, err := deviceMappings(loopDevice, log)
+	if err != nil {
+		return nil, err
+	}
+
+	names = withStackedMappings(names)
+
+	report := &CleanupReport{}
+	var errs []error
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return report, fmt.Errorf("cleaning up mappings for %s: %w", loopDevice, err)
+		}
+
+		nodes := lookupMappingNodes(name)
+		err := removeMappingWithRetry(ctx, name, opts, log)
+		deferred := false
+		if err != nil && opts.DeferredRemove && errors.Is(err, syscall.EBUSY) {
+			log.Printf("Mapping %s is busy, deferring its removal", name)
+			err = removeMapping(name, true)
+			deferred = err == nil
+		}
+
+		switch {
+		case err == nil && deferred:
+			report.Deferred = append(report.Deferred, name)
+		case err == nil:
+			log.Printf("Removed mapping %s", name)
+			report.Removed = append(report.Removed, name)
+		default:
+			log.Printf("%v", err)
+			errs = append(errs, err)
+			if errors.Is(err, syscall.EBUSY) {
+				report.Busy = append(report.Busy, BusyMapping{Name: name, Processes: mappingHolders(name)})
+			}
+			continue
+		}
+
+		nodes.remove(log)
+		journalRemove(journalKindMapping, name, log)
+	}
+
+	return report, errors.Join(errs...)
+}
+
+// withStackedMappings puts the mappings stacked on each mapping, like a crypt device on a partition, before it
+// so that stacks are torn down from the top
+func withStackedMappings(names []string) []string {
+	var ordered []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			ordered = append(ordered, name)
+		}
+	}
+	for _, name := range names {
+		if dir, err := sysBlockDir(mappingPath(name)); err == nil {
+			for _, holder := range holderMappings(filepath.Base(dir)) {
+				add(holder)
+			}
+		}
+		add(name)
+	}
+	return ordered
+}
+
+// removeMappingStack removes a mapping and the ones stacked on it, top-most first. A missing mapping is not an error.
+func removeMappingStack(name string, log Logger) error {
+	if _, err := os.Stat(mappingPath(name)); os.IsNotExist(err) {
+		return nil
+	}
+	var errs []error
+	for _, m := range withStackedMappings([]string{name}) {
+		nodes := lookupMappingNodes(m)
+		if err := removeMapping(m, false); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nodes.remove(log)
+		journalRemove(journalKindMapping, m, log)
+	}
+	return errors.Join(errs...)
+}
+
+// removeMappingWithRetry removes a mapping, trying again with exponential backoff while it is busy
+func removeMappingWithRetry(ctx context.Context, name string, opts CleanupOptions, log Logger) error {
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	err := removeMapping(name, false)
+	for attempt := 1; attempt <= opts.Retries && errors.Is(err, syscall.EBUSY); attempt++ {
+		log.Printf("Mapping %s is busy, retrying in %s (%d/%d)", name, backoff, attempt, opts.Retries)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("removing %s: %w", name, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = removeMapping(name, false)
+	}
+	return err
+}
+
+// mappingHolders returns the processes that have the named mapping open
+func mappingHolders(name string) []Process {
+	dmDirs, _ := filepath.Glob("/sys/block/dm-*")
+	for _, dir := range dmDirs {
+		dmName, err := os.ReadFile(filepath.Join(dir, "dm", "name"))
+		if err != nil || strings.TrimSpace(string(dmName)) != name {
+			continue
+		}
+		dev, err := readDevNumber(dir)
+		if err != nil {
+			return nil
+		}
+		return processesUsing(map[uint64]bool{dev: true})
+	}
+	return nil
+}
+
+// processesUsing scans /proc for processes with an open fd on any of the given block devices
+func processesUsing(devices map[uint64]bool) []Process {
+	procs, _ := os.ReadDir("/proc")
+
+	var found []Process
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			var st syscall.Stat_t
+			if err := syscall.Stat(filepath.Join(fdDir, fd.Name()), &st); err != nil {
+				continue
+			}
+			if st.Mode&syscall.S_IFMT == syscall.S_IFBLK && devices[uint64(st.Rdev)] {
+				comm, _ := os.ReadFile(filepath.Join("/proc", p.Name(), "comm"))
+				found = append(found, Process{PID: pid, Command: strings.TrimSpace(string(comm))})
+				break
+			}
+		}
+	}
+	return found
+}
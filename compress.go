@@ -0,0 +1,270 @@
+package loopback
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// stagingChunkSize is the unit in which decompressed images are written, all-zero chunks are left as holes
+const stagingChunkSize = 64 << 10
+
+// compressionMagics maps the supported compression formats to the magic bytes their streams start with
+var compressionMagics = []struct {
+	format string
+	magic  []byte
+}{
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// imageCompression returns the compression format of the image file, or an empty string for an uncompressed one
+func imageCompression(img string) (string, error) {
+	f, err := os.Open(img)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 6)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	for _, c := range compressionMagics {
+		if bytes.HasPrefix(magic[:n], c.magic) {
+			return c.format, nil
+		}
+	}
+	return "", nil
+}
+
+// newDecompressor returns a reader decompressing r, which holds a stream in the given format
+func newDecompressor(format string, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "xz":
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression format %q", format)
+	}
+}
+
+// stageCompressedImage decompresses the image and returns the decompressed copy, for the loop device to use as its
+// backing file. It is opened read-only with opts.ReadOnly and read-write otherwise. The copy lives in a memfd or in an already unlinked file in
+// opts.StagingDir, so the kernel frees it once the loop device lets go of it on Unloop. With opts.CacheDir it is
+// kept in the cache instead, a writable attach then gets its own staged copy of the cached one.
+func stageCompressedImage(ctx context.Context, img, format string, opts LoopOptions, log Logger) (*os.File, error) {
+	src, err := os.Open(img)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	if opts.CacheDir != "" {
+		cached, err := cachedImage(ctx, src, format, opts.CacheDir, log)
+		if err != nil {
+			return nil, err
+		}
+		if opts.ReadOnly {
+			return cached, nil
+		}
+		defer cached.Close()
+		log.Printf("Staging a writable copy of %s", cached.Name())
+		return stageImage(ctx, cached, opts)
+	}
+
+	r, err := newDecompressor(format, src)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s image %s: %w", format, img, err)
+	}
+	defer r.Close()
+
+	log.Printf("Decompressing %s image %s", format, img)
+	f, err := stageImage(ctx, r, opts)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", img, err)
+	}
+	if opts.ReadOnly {
+		defer f.Close()
+		return openReadOnly(f)
+	}
+	return f, nil
+}
+
+// cachedImage returns the decompressed copy of src in cacheDir, named after the SHA-256 of the compressed data,
+// decompressing it first if it is not cached yet. The copy is opened read-only.
+func cachedImage(ctx context.Context, src *os.File, format, cacheDir string, log Logger) (*os.File, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", src.Name(), err)
+	}
+	path := filepath.Join(cacheDir, hex.EncodeToString(h.Sum(nil))+".img")
+	if f, err := os.Open(path); err == nil {
+		log.Printf("Using cached decompressed copy %s of %s", path, src.Name())
+		return f, nil
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r, err := newDecompressor(format, src)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s image %s: %w", format, src.Name(), err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	// Decompress next to the final name and rename it in place, so concurrent attaches never see a partial copy
+	tmp, err := os.CreateTemp(cacheDir, ".staging-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	log.Printf("Decompressing %s image %s into %s", format, src.Name(), path)
+	if err := writeSparse(ctx, tmp, r); err != nil {
+		return nil, fmt.Errorf("decompressing %s: %w", src.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// stageImage copies r into a memfd, or into an unlinked temporary file once it grows past opts.MemfdLimit
+func stageImage(ctx context.Context, r io.Reader, opts LoopOptions) (*os.File, error) {
+	var f *os.File
+	var err error
+	if opts.MemfdLimit > 0 {
+		f, err = newMemfd("loopback-staging")
+		r = &spillReader{Reader: r, limit: opts.MemfdLimit}
+	} else {
+		f, err = newStagingFile(opts.StagingDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeSparse(ctx, f, r)
+	if spill, ok := r.(*spillReader); ok && spill.spilled {
+		// Too big for memory, move what was written so far to a file and carry on there
+		var file *os.File
+		if file, err = newStagingFile(opts.StagingDir); err == nil {
+			err = writeSparse(ctx, file, io.MultiReader(io.NewSectionReader(f, 0, spill.n), spill.Reader))
+			f.Close()
+			f = file
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// spillReader stops with io.EOF, setting spilled, once more than limit bytes were read
+type spillReader struct {
+	io.Reader
+	limit   int64
+	n       int64
+	spilled bool
+}
+
+func (s *spillReader) Read(p []byte) (int, error) {
+	if s.spilled {
+		return 0, io.EOF
+	}
+	if s.n >= s.limit {
+		// Check there is more to read before giving up on memory
+		var one [1]byte
+		n, err := s.Reader.Read(one[:])
+		if n == 0 {
+			return 0, err
+		}
+		s.Reader = io.MultiReader(bytes.NewReader(one[:n]), s.Reader)
+		s.spilled = true
+		return 0, io.EOF
+	}
+	n, err := s.Reader.Read(p[:min(int64(len(p)), s.limit-s.n)])
+	s.n += int64(n)
+	return n, err
+}
+
+// openReadOnly opens the file f is open on again, read-only. The kernel only makes a loop device read-only when
+// the fd handed to LOOP_SET_FD is. Going through /proc/self/fd also works for memfds and unlinked files, which
+// have no path to open again.
+func openReadOnly(f *os.File) (*os.File, error) {
+	fd, err := unix.Open(fmt.Sprintf("/proc/self/fd/%d", f.Fd()), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reopening %s read-only: %w", f.Name(), err)
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// newStagingFile creates a temporary file in dir, or os.TempDir() if empty, and unlinks it right away so it
+// disappears with its last user
+func newStagingFile(dir string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, "loopback-staging-*.img")
+	if err != nil {
+		return nil, fmt.Errorf("creating staging file: %w", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unlinking staging file: %w", err)
+	}
+	return f, nil
+}
+
+// writeSparse copies r to the start of f, leaving all-zero chunks as holes, and truncates f to the copied size
+func writeSparse(ctx context.Context, f *os.File, r io.Reader) error {
+	buf := make([]byte, stagingChunkSize)
+	zero := make([]byte, stagingChunkSize)
+	var off int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := f.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return f.Truncate(off)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
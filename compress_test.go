@@ -0,0 +1,175 @@
+package loopback
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// testImage is 4MiB of zeroes with some data at both ends
+func testImage() []byte {
+	img := make([]byte, 4<<20)
+	copy(img, bytes.Repeat([]byte("head"), 1024))
+	copy(img[len(img)-4096:], bytes.Repeat([]byte("tail"), 1024))
+	return img
+}
+
+func compressTestImage(t *testing.T, format string, img []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(img)
+	w.Close()
+
+	path := filepath.Join(t.TempDir(), "disk.img."+format)
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkStaged makes sure f holds img and only allocates the blocks holding data
+func checkStaged(t *testing.T, f *os.File, img []byte) {
+	t.Helper()
+	got := make([]byte, len(img)+1)
+	n, _ := f.ReadAt(got, 0)
+	if !bytes.Equal(got[:n], img) {
+		t.Fatalf("Staged copy differs from the image (%d bytes, expected %d)", n, len(img))
+	}
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated := st.Sys().(*syscall.Stat_t).Blocks * 512; allocated > 1<<20 {
+		t.Fatalf("Staged copy is not sparse, %d bytes allocated", allocated)
+	}
+}
+
+func TestStageCompressedImage(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	img := testImage()
+
+	for _, format := range []string{"xz", "gzip", "zstd"} {
+		t.Run(format, func(t *testing.T) {
+			path := compressTestImage(t, format, img)
+			got, err := imageCompression(path)
+			if err != nil || got != format {
+				t.Fatalf("imageCompression() returned %q, %v", got, err)
+			}
+
+			stagingDir := t.TempDir()
+			f, err := stageCompressedImage(context.Background(), path, format, LoopOptions{StagingDir: stagingDir}, logger)
+			if err != nil {
+				t.Fatalf("stageCompressedImage() failed: %v", err)
+			}
+			defer f.Close()
+			checkStaged(t, f, img)
+			if entries, _ := os.ReadDir(stagingDir); len(entries) != 0 {
+				t.Fatalf("Staging file was not unlinked: %v", entries)
+			}
+		})
+	}
+
+	raw := filepath.Join(t.TempDir(), "disk.img")
+	os.WriteFile(raw, img, 0o644)
+	if format, err := imageCompression(raw); err != nil || format != "" {
+		t.Fatalf("Expected an uncompressed image, got %q, %v", format, err)
+	}
+}
+
+func TestStageCompressedImageReadOnly(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	img := testImage()
+	path := compressTestImage(t, "gzip", img)
+
+	for _, opts := range []LoopOptions{{ReadOnly: true}, {ReadOnly: true, MemfdLimit: 8 << 20}} {
+		f, err := stageCompressedImage(context.Background(), path, "gzip", opts, logger)
+		if err != nil {
+			t.Fatalf("stageCompressedImage() failed: %v", err)
+		}
+		// The loop device is only read-only if the fd it gets is
+		mode, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+		if err != nil || mode&unix.O_ACCMODE != unix.O_RDONLY {
+			t.Fatalf("Expected a read-only staged copy with %+v, got mode %#o (%v)", opts, mode, err)
+		}
+		checkStaged(t, f, img)
+		f.Close()
+	}
+}
+
+func TestStageImageMemfd(t *testing.T) {
+	img := testImage()
+	for _, limit := range []int64{8 << 20, 1 << 20, 3} {
+		f, err := stageImage(context.Background(), bytes.NewReader(img), LoopOptions{StagingDir: t.TempDir(), MemfdLimit: limit})
+		if err != nil {
+			t.Fatalf("stageImage() with a %d bytes limit failed: %v", limit, err)
+		}
+		inMemory := f.Name() == "/memfd:loopback-staging"
+		if inMemory != (limit > int64(len(img))) {
+			t.Fatalf("Unexpected staging in %s with a %d bytes limit", f.Name(), limit)
+		}
+		checkStaged(t, f, img)
+		f.Close()
+	}
+}
+
+func TestStageCompressedImageCache(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	img := testImage()
+	path := compressTestImage(t, "zstd", img)
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	opts := LoopOptions{ReadOnly: true, CacheDir: cacheDir}
+
+	first, err := stageCompressedImage(context.Background(), path, "zstd", opts, logger)
+	if err != nil {
+		t.Fatalf("stageCompressedImage() failed: %v", err)
+	}
+	defer first.Close()
+	checkStaged(t, first, img)
+
+	second, err := stageCompressedImage(context.Background(), path, "zstd", opts, logger)
+	if err != nil {
+		t.Fatalf("stageCompressedImage() from the cache failed: %v", err)
+	}
+	defer second.Close()
+	if first.Name() != second.Name() || filepath.Dir(first.Name()) != cacheDir {
+		t.Fatalf("Expected the cached copy to be reused, got %s and %s", first.Name(), second.Name())
+	}
+
+	// A writable attach must not write to the cached copy
+	opts.ReadOnly = false
+	writable, err := stageCompressedImage(context.Background(), path, "zstd", opts, logger)
+	if err != nil {
+		t.Fatalf("stageCompressedImage() for writing failed: %v", err)
+	}
+	defer writable.Close()
+	if writable.Name() == first.Name() {
+		t.Fatalf("Writable attach got the cached copy itself")
+	}
+	checkStaged(t, writable, img)
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 1 {
+		t.Fatalf("Expected a single cached copy, got %v", entries)
+	}
+}
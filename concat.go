@@ -0,0 +1,127 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ConcatDevice is a device-mapper device made of several images or block devices laid end to end
+type ConcatDevice struct {
+	name string
+	// loops are the loop devices attached for the image files, block devices are used directly
+	loops []string
+	// created is set once the mapping is ours, before that a mapping called name belongs to someone else
+	created bool
+	log     Logger
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Concat builds a linear mapping called name out of the given images or block devices, in order, so they behave
+// as a single disk that GetGPTPartitions and CreateMappingsFromDevice can work on. Image files are attached to
+// loop devices with opts. Every part but the last must be a whole number of sectors.
+func Concat(ctx context.Context, name string, parts []string, opts LoopOptions, log Logger) (*ConcatDevice, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("nothing to concatenate into %s", name)
+	}
+
+	c := &ConcatDevice{name: name, log: log}
+	var targets []Target
+	var start uint64
+	for i, part := range parts {
+		st, err := os.Stat(part)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if st.Mode().IsRegular() && i < len(parts)-1 && st.Size()%sectorSize != 0 {
+			c.Close()
+			return nil, fmt.Errorf("%s is not a multiple of %d bytes, the parts after it would be shifted", part, sectorSize)
+		}
+
+		device := part
+		if st.Mode().IsRegular() {
+			device, err = LoopWithOptions(ctx, part, opts, log)
+			if err != nil {
+				c.Close()
+				return nil, fmt.Errorf("attaching %s: %w", part, err)
+			}
+			c.loops = append(c.loops, device)
+		} else if st.Mode()&os.ModeDevice == 0 || st.Mode()&os.ModeCharDevice != 0 {
+			c.Close()
+			return nil, fmt.Errorf("%s is neither an image file nor a block device", part)
+		}
+
+		sectors, err := deviceSectors(device)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if sectors == 0 {
+			continue
+		}
+		targets = append(targets, Target{Start: start, Length: sectors, Type: "linear", Params: device + " 0"})
+		start += sectors
+	}
+	if start == 0 {
+		c.Close()
+		return nil, fmt.Errorf("the parts of %s are empty", name)
+	}
+
+	log.Printf("Creating %s from %d parts, %d sectors", name, len(targets), start)
+	err := dmCreate(ctx, dmDevice{
+		Name:     name,
+		Targets:  targets,
+		ReadOnly: opts.ReadOnly,
+		Backing:  strings.Fields(targets[0].Params)[0],
+	}, log)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.created = true
+
+	return c, nil
+}
+
+// Path returns the /dev/mapper path of the concatenated device
+func (c *ConcatDevice) Path() string {
+	return mappingPath(c.name)
+}
+
+// LoopDevices returns the loop devices attached for the image files, in order
+func (c *ConcatDevice) LoopDevices() []string {
+	return c.loops
+}
+
+// Close removes the device, along with the mappings stacked on it like its partitions, and detaches the loop
+// devices. Every step runs even if a previous one failed and all errors are returned. Calling Close again is a no-op.
+func (c *ConcatDevice) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	var errs []error
+	if c.created {
+		if err := UnmountAll(c.Path(), c.log); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("unmounting: %w", err))
+		}
+		if err := removeMappingStack(c.name, c.log); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, dev := range c.loops {
+		if err := Unloop(dev, c.log); err != nil {
+			errs = append(errs, fmt.Errorf("detaching %s: %w", dev, err))
+		}
+	}
+	return errors.Join(errs...)
+}
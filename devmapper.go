@@ -6,7 +6,14 @@ package loopback
 
 enum {
 	DeviceCreate = 0,
+	DeviceReload = 1,
+	DeviceRemove = 2,
+	DeviceSuspend = 4,
 	DeviceResume = 5,
+	DeviceStatus = 10,
+	DeviceTable = 11,
+	DeviceList = 13,
+	DeviceTargetMsg = 17,
 };
 
 #define ADD_NODE_ON_RESUME DM_ADD_NODE_ON_RESUME
@@ -14,6 +21,7 @@ enum {
 import "C"
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -27,6 +35,12 @@ import (
 
 // CreateMappingsFromDevice sets up device-mapper mappings for each GPT partition on the specified loop device.
 func CreateMappingsFromDevice(loopDevice string, log Logger) error {
+	return CreateMappingsFromDeviceContext(context.Background(), loopDevice, log)
+}
+
+// CreateMappingsFromDeviceContext is like CreateMappingsFromDevice but gives up waiting for udev and the device
+// nodes when ctx is done. On failure the mappings created so far are removed.
+func CreateMappingsFromDeviceContext(ctx context.Context, loopDevice string, log Logger) error {
 	log.Printf("Starting device-mapper setup for %s", loopDevice)
 
 	partitions, err := GetGPTPartitions(loopDevice)
@@ -34,170 +48,572 @@ func CreateMappingsFromDevice(loopDevice string, log Logger) error {
 		return fmt.Errorf("failed to read GPT partitions from %s: %w", loopDevice, err)
 	}
 
+	var created []string
 	for _, p := range partitions {
-		dmName := fmt.Sprintf("loop%dp%d", getLoopNumber(loopDevice), p.Number)
-		log.Printf("Creating mapping for partition %d (%s)", p.Number, dmName)
-
-		taskCreate := C.dm_task_create(C.int(C.DeviceCreate))
-		if taskCreate == nil {
-			return fmt.Errorf("dm_task_create for DeviceCreate failed for %s", dmName)
+		dmName := partitionMappingName(loopDevice, p.Number)
+		err := ctx.Err()
+		if err == nil {
+			err = createMapping(ctx, dmName, loopDevice, p, log)
+		}
+		if err != nil {
+			log.Printf("Rolling back mappings for %s", loopDevice)
+			for _, name := range created {
+				nodes := lookupMappingNodes(name)
+				if rmErr := removeMapping(name, false); rmErr != nil {
+					log.Printf("%v", rmErr)
+				} else {
+					nodes.remove(log)
+					journalRemove(journalKindMapping, name, log)
+				}
+			}
+			return err
 		}
-		defer C.dm_task_destroy(taskCreate)
+		created = append(created, dmName)
+	}
+	return nil
+}
 
-		dmNameC := C.CString(dmName)
-		defer C.free(unsafe.Pointer(dmNameC))
+// createMapping creates and activates a linear mapping for a single partition and waits for its device node
+func createMapping(ctx context.Context, dmName, loopDevice string, p Partition, log Logger) error {
+	log.Printf("Creating mapping for partition %d (%s)", p.Number, dmName)
 
-		if C.dm_task_set_name(taskCreate, dmNameC) != 1 {
-			return fmt.Errorf("dm_task_set_name failed for %s", dmName)
-		}
+	err := dmCreate(ctx, dmDevice{
+		Name:    dmName,
+		Backing: loopDevice,
+		Targets: []Target{{Length: p.NumSectors, Type: "linear", Params: fmt.Sprintf("%s %d", loopDevice, p.FirstLBA)}},
+	}, log)
+	if err != nil {
+		return err
+	}
 
-		targetType := C.CString("linear")
-		targetParams := C.CString(fmt.Sprintf("%s %d", loopDevice, p.FirstLBA))
-		defer C.free(unsafe.Pointer(targetType))
-		defer C.free(unsafe.Pointer(targetParams))
+	// Without devtmpfs or udev (like in some containers) there is no /dev/dm-N node, create it the way the
+	// kernel would and point the /dev/mapper entry at it
+	dmPath := mappingPath(dmName)
+	nodes := lookupMappingNodes(dmName)
+	if !nodes.found {
+		log.Printf("Device %s not found in /sys/block", dmName)
+		return nil
+	}
+	major, minor := unix.Major(nodes.dev), unix.Minor(nodes.dev)
+	dmDevPath := dmNodePath(nodes.dev)
+	if _, err := os.Lstat(dmDevPath); err == nil {
+		log.Printf("Device %s ready (major:minor = %d:%d)", dmPath, major, minor)
+		return nil
+	}
+	if err := unix.Mknod(dmDevPath, unix.S_IFBLK|0600, int(nodes.dev)); err != nil {
+		log.Printf("Failed to create device node %s: %v", dmDevPath, err)
+		return nil
+	}
+	log.Printf("Created device node %s (major:minor = %d:%d)", dmDevPath, major, minor)
 
-		if C.dm_task_add_target(taskCreate, 0, C.uint64_t(p.NumSectors), targetType, targetParams) != 1 {
-			return fmt.Errorf("dm_task_add_target failed for %s", dmName)
-		}
+	// Only replace the node libdevmapper made for this very device
+	if isBlockNode(dmPath, nodes.dev) {
+		os.Remove(dmPath)
+	}
+	relTarget, err := filepath.Rel(filepath.Dir(dmPath), dmDevPath)
+	if err != nil {
+		relTarget = dmDevPath // fallback to absolute if relative fails
+	}
+	if err := os.Symlink(relTarget, dmPath); err != nil {
+		log.Printf("Failed to create symlink %s -> %s: %v", dmPath, relTarget, err)
+	} else {
+		log.Printf("Created symlink %s -> %s", dmPath, relTarget)
+	}
+	log.Printf("Device %s ready (major:minor = %d:%d)", dmPath, major, minor)
+	return nil
+}
 
-		if C.dm_task_set_add_node(taskCreate, C.ADD_NODE_ON_RESUME) != 1 {
-			return fmt.Errorf("dm_task_set_add_node failed for %s", dmName)
-		}
+// dmDevice describes a device-mapper device to create
+type dmDevice struct {
+	Name    string
+	UUID    string
+	Targets []Target
+	// ReadOnly loads the table read-only
+	ReadOnly bool
+	// Secure asks libdevmapper to wipe the ioctl buffers, for tables holding keys
+	Secure bool
+	// Backing is recorded in the state journal as the device the mapping depends on
+	Backing string
+}
+
+// dmCreate creates the device with its table, resumes it and waits for its /dev/mapper node.
+// If anything fails after the device was created it is removed again.
+func dmCreate(ctx context.Context, dev dmDevice, log Logger) error {
+	dmName := dev.Name
+
+	taskCreate := C.dm_task_create(C.int(C.DeviceCreate))
+	if taskCreate == nil {
+		return &DMError{Op: "create", Call: "dm_task_create for DeviceCreate", Name: dmName}
+	}
+	defer C.dm_task_destroy(taskCreate)
 
-		if C.dm_task_run(taskCreate) != 1 {
-			return fmt.Errorf("dm_task_run (DeviceCreate) failed for %s", dmName)
+	dmNameC := C.CString(dmName)
+	defer C.free(unsafe.Pointer(dmNameC))
+
+	if C.dm_task_set_name(taskCreate, dmNameC) != 1 {
+		return &DMError{Op: "create", Call: "dm_task_set_name", Name: dmName}
+	}
+
+	if dev.UUID != "" {
+		uuidC := C.CString(dev.UUID)
+		defer C.free(unsafe.Pointer(uuidC))
+		if C.dm_task_set_uuid(taskCreate, uuidC) != 1 {
+			return &DMError{Op: "create", Call: "dm_task_set_uuid", Name: dmName}
 		}
+	}
+
+	if dev.ReadOnly && C.dm_task_set_ro(taskCreate) != 1 {
+		return &DMError{Op: "create", Call: "dm_task_set_ro", Name: dmName}
+	}
+
+	if dev.Secure && C.dm_task_secure_data(taskCreate) != 1 {
+		return &DMError{Op: "create", Call: "dm_task_secure_data", Name: dmName}
+	}
+
+	if err := addTargets(taskCreate, "create", dmName, dev.Targets); err != nil {
+		return err
+	}
+
+	if C.dm_task_set_add_node(taskCreate, C.ADD_NODE_ON_RESUME) != 1 {
+		return &DMError{Op: "create", Call: "dm_task_set_add_node", Name: dmName}
+	}
+
+	if C.dm_task_run(taskCreate) != 1 {
+		return dmTaskError("create", "dm_task_run (DeviceCreate)", dmName, taskCreate)
+	}
+
+	log.Printf("Device %s created (suspended state)", dmName)
 
-		log.Printf("Device %s created (suspended state)", dmName)
+	if err := Resume(dmName); err != nil {
+		return removeAfterFailure(dmName, err, log)
+	}
+
+	log.Printf("Device %s resumed (active)", dmName)
+	journalAdd(journalKindMapping, dmName, dev.Backing, log)
+
+	// Trigger udev or manually create device node if necessary
+	if err := udevWait(ctx); err != nil {
+		log.Printf("dm_udev_wait failed for %s, node may not be created automatically: %v", dmName, err)
+	}
 
-		taskResume := C.dm_task_create(C.int(C.DeviceResume))
-		if taskResume == nil {
-			return fmt.Errorf("dm_task_create for DeviceResume failed for %s", dmName)
+	dmPath := "/dev/mapper/" + dmName
+	waitCtx, cancel := context.WithTimeout(ctx, deviceWaitTimeout)
+	defer cancel()
+	if err := WaitForDevice(waitCtx, dmPath); err != nil {
+		// Only give up if our caller cancelled, a missing node is not fatal on its own
+		if ctx.Err() != nil {
+			return removeAfterFailure(dmName, fmt.Errorf("waiting for %s: %w", dmPath, ctx.Err()), log)
 		}
-		defer C.dm_task_destroy(taskResume)
+		log.Printf("Device node %s not found: %v", dmPath, err)
+	}
+	return nil
+}
 
-		if C.dm_task_set_name(taskResume, dmNameC) != 1 {
-			return fmt.Errorf("dm_task_set_name (resume) failed for %s", dmName)
+// addTargets appends the table segments to a create or reload task
+func addTargets(task *C.struct_dm_task, op, dmName string, targets []Target) error {
+	for _, t := range targets {
+		targetType := C.CString(t.Type)
+		targetParams := C.CString(t.Params)
+		ok := C.dm_task_add_target(task, C.uint64_t(t.Start), C.uint64_t(t.Length), targetType, targetParams) == 1
+		C.free(unsafe.Pointer(targetType))
+		C.free(unsafe.Pointer(targetParams))
+		if !ok {
+			return &DMError{Op: op, Call: "dm_task_add_target", Name: dmName}
 		}
+	}
+	return nil
+}
+
+// Resume activates the table loaded on a device, swapping it with the live one after a ReloadTable
+func Resume(dmName string) error {
+	return runNamedTask("resume", C.DeviceResume, "DeviceResume", dmName)
+}
+
+// Suspend suspends a device, flushing pending I/O first. I/O is queued until it is resumed.
+func Suspend(dmName string) error {
+	return runNamedTask("suspend", C.DeviceSuspend, "DeviceSuspend", dmName)
+}
+
+// runNamedTask runs a task that only needs the device name
+func runNamedTask(op string, taskType C.int, typeName, dmName string) error {
+	dmNameC := C.CString(dmName)
+	defer C.free(unsafe.Pointer(dmNameC))
+
+	task := C.dm_task_create(taskType)
+	if task == nil {
+		return &DMError{Op: op, Call: "dm_task_create for " + typeName, Name: dmName}
+	}
+	defer C.dm_task_destroy(task)
+
+	if C.dm_task_set_name(task, dmNameC) != 1 {
+		return &DMError{Op: op, Call: "dm_task_set_name (" + op + ")", Name: dmName}
+	}
+
+	if C.dm_task_run(task) != 1 {
+		return dmTaskError(op, "dm_task_run ("+typeName+")", dmName, task)
+	}
+	return nil
+}
+
+// ReloadTable loads a new table in the inactive slot of a device, it replaces the live one on the next resume
+func ReloadTable(dmName string, targets []Target) error {
+	if err := validateTable(targets); err != nil {
+		return fmt.Errorf("reloading %s: %w", dmName, err)
+	}
+
+	dmNameC := C.CString(dmName)
+	defer C.free(unsafe.Pointer(dmNameC))
+
+	task := C.dm_task_create(C.int(C.DeviceReload))
+	if task == nil {
+		return &DMError{Op: "reload", Call: "dm_task_create for DeviceReload", Name: dmName}
+	}
+	defer C.dm_task_destroy(task)
+
+	if C.dm_task_set_name(task, dmNameC) != 1 {
+		return &DMError{Op: "reload", Call: "dm_task_set_name (reload)", Name: dmName}
+	}
+	if err := addTargets(task, "reload", dmName, targets); err != nil {
+		return err
+	}
+	if C.dm_task_run(task) != 1 {
+		return dmTaskError("reload", "dm_task_run (DeviceReload)", dmName, task)
+	}
+	return nil
+}
+
+// dmReplaceTable swaps the live table of a device: the new one is loaded, then the device is suspended and resumed
+func dmReplaceTable(dmName string, targets []Target) error {
+	if err := ReloadTable(dmName, targets); err != nil {
+		return err
+	}
+	if err := Suspend(dmName); err != nil {
+		return err
+	}
+	return Resume(dmName)
+}
+
+// dmMessage sends a message to the target of a device at the given sector, like `dmsetup message`
+func dmMessage(dmName string, sector uint64, message string) error {
+	dmNameC := C.CString(dmName)
+	defer C.free(unsafe.Pointer(dmNameC))
+	messageC := C.CString(message)
+	defer C.free(unsafe.Pointer(messageC))
+
+	task := C.dm_task_create(C.int(C.DeviceTargetMsg))
+	if task == nil {
+		return &DMError{Op: "message", Call: "dm_task_create for DeviceTargetMsg", Name: dmName}
+	}
+	defer C.dm_task_destroy(task)
+
+	if C.dm_task_set_name(task, dmNameC) != 1 {
+		return &DMError{Op: "message", Call: "dm_task_set_name (message)", Name: dmName}
+	}
+	if C.dm_task_set_sector(task, C.uint64_t(sector)) != 1 {
+		return &DMError{Op: "message", Call: "dm_task_set_sector", Name: dmName}
+	}
+	if C.dm_task_set_message(task, messageC) != 1 {
+		return &DMError{Op: "message", Call: "dm_task_set_message", Name: dmName}
+	}
+	if C.dm_task_run(task) != 1 {
+		return dmTaskError("message", "dm_task_run (DeviceTargetMsg)", dmName, task)
+	}
+	return nil
+}
 
-		if C.dm_task_run(taskResume) != 1 {
-			return fmt.Errorf("dm_task_run (DeviceResume) failed for %s", dmName)
+// dmTargets returns the live table of a device, or with status set the status line of each of its targets
+// in Params
+func dmTargets(dmName string, status bool) ([]Target, error) {
+	op, taskType, typeName := "table", C.int(C.DeviceTable), "DeviceTable"
+	if status {
+		op, taskType, typeName = "status", C.int(C.DeviceStatus), "DeviceStatus"
+	}
+
+	dmNameC := C.CString(dmName)
+	defer C.free(unsafe.Pointer(dmNameC))
+
+	task := C.dm_task_create(taskType)
+	if task == nil {
+		return nil, &DMError{Op: op, Call: "dm_task_create for " + typeName, Name: dmName}
+	}
+	defer C.dm_task_destroy(task)
+
+	if C.dm_task_set_name(task, dmNameC) != 1 {
+		return nil, &DMError{Op: op, Call: "dm_task_set_name (" + op + ")", Name: dmName}
+	}
+	if C.dm_task_run(task) != 1 {
+		return nil, dmTaskError(op, "dm_task_run ("+typeName+")", dmName, task)
+	}
+
+	var targets []Target
+	var next unsafe.Pointer
+	for {
+		var start, length C.uint64_t
+		var targetType, params *C.char
+		next = C.dm_get_next_target(task, next, &start, &length, &targetType, &params)
+		if targetType != nil {
+			targets = append(targets, Target{
+				Start:  uint64(start),
+				Length: uint64(length),
+				Type:   C.GoString(targetType),
+				Params: C.GoString(params),
+			})
+		}
+		if next == nil {
+			break
 		}
+	}
+	return targets, nil
+}
 
-		log.Printf("Device %s resumed (active)", dmName)
+// Table returns the live table of a device, like `dmsetup table`
+func Table(name string) ([]Target, error) {
+	return dmTargets(name, false)
+}
 
-		// Trigger udev or manually create device node if necessary
-		if C.dm_udev_wait(C.uint32_t(0)) != 1 {
-			log.Printf("dm_udev_wait failed for %s, node may not be created automatically", dmName)
+// Status returns the targets of a device with their status line in Params, like `dmsetup status`
+func Status(name string) ([]Target, error) {
+	return dmTargets(name, true)
+}
+
+// MappedDevice is a device-mapper device as returned by List
+type MappedDevice struct {
+	Name  string
+	Major uint32
+	Minor uint32
+}
+
+// List returns every device-mapper device, like `dmsetup ls`
+func List() ([]MappedDevice, error) {
+	task := C.dm_task_create(C.int(C.DeviceList))
+	if task == nil {
+		return nil, &DMError{Op: "list", Call: "dm_task_create for DeviceList"}
+	}
+	defer C.dm_task_destroy(task)
+
+	if C.dm_task_run(task) != 1 {
+		return nil, dmTaskError("list", "dm_task_run (DeviceList)", "", task)
+	}
+
+	names := C.dm_task_get_names(task)
+	if names == nil {
+		return nil, &DMError{Op: "list", Call: "dm_task_get_names"}
+	}
+
+	var devices []MappedDevice
+	// An empty list is a single entry with dev set to 0, entries are chained by their offset to the next one
+	for names.dev != 0 {
+		name := (*C.char)(unsafe.Add(unsafe.Pointer(names), unsafe.Offsetof(names.name)))
+		devices = append(devices, MappedDevice{
+			Name:  C.GoString(name),
+			Major: unix.Major(uint64(names.dev)),
+			Minor: unix.Minor(uint64(names.dev)),
+		})
+		if names.next == 0 {
+			break
 		}
+		names = (*C.struct_dm_names)(unsafe.Add(unsafe.Pointer(names), names.next))
+	}
+	return devices, nil
+}
 
-		// After resuming the device, manually create a device node under /dev/dm-NUMBER
-		dmNum := getLoopNumber(dmName) // Use the partition number as the dm number
-		dmDevPath := fmt.Sprintf("/dev/dm-%d", dmNum)
-		dmPath := "/dev/mapper/" + dmName
-		if stat, err := os.Stat(dmPath); err == nil {
-			rdev := stat.Sys().(*syscall.Stat_t).Rdev
-			major := unix.Major(rdev)
-			minor := unix.Minor(rdev)
-			// Remove if already exists
-			os.Remove(dmDevPath)
-			// Create the device node under /dev/dm-NUMBER
-			err = unix.Mknod(dmDevPath, unix.S_IFBLK|0600, int(unix.Mkdev(major, minor)))
-			if err != nil {
-				log.Printf("Failed to create device node %s: %v", dmDevPath, err)
-			} else {
-				log.Printf("Created device node %s (major:minor = %d:%d)", dmDevPath, major, minor)
-				// Remove symlink if it exists
-				os.Remove(dmPath)
-				// Create the symlink from /dev/mapper/loopXpY to ../dm-NUMBER (relative)
-				relTarget, relErr := filepath.Rel(filepath.Dir(dmPath), dmDevPath)
-				if relErr != nil {
-					relTarget = dmDevPath // fallback to absolute if relative fails
-				}
-				err = os.Symlink(relTarget, dmPath)
-				if err != nil {
-					log.Printf("Failed to create symlink %s -> %s: %v", dmPath, relTarget, err)
-				} else {
-					log.Printf("Created symlink %s -> %s", dmPath, relTarget)
-				}
+// CreateDevice creates and activates a device-mapper device called name with the given table, like
+// `dmsetup create`. The uuid is optional.
+func CreateDevice(name, uuid string, targets []Target, log Logger) error {
+	return CreateDeviceContext(context.Background(), name, uuid, targets, log)
+}
+
+// CreateDeviceContext is like CreateDevice but gives up waiting for udev and the device node when ctx is done,
+// removing the device again
+func CreateDeviceContext(ctx context.Context, name, uuid string, targets []Target, log Logger) error {
+	if err := validateTable(targets); err != nil {
+		return fmt.Errorf("creating %s: %w", name, err)
+	}
+	return dmCreate(ctx, dmDevice{Name: name, UUID: uuid, Targets: targets, Backing: tableBacking(targets)}, log)
+}
+
+// tableBacking returns the first device path found in the parameters of a table, recorded in the state journal
+// so Reap can tell the mapping is still ours
+func tableBacking(targets []Target) string {
+	for _, t := range targets {
+		for _, param := range strings.Fields(t.Params) {
+			if strings.HasPrefix(param, "/dev/") {
+				return param
 			}
-			log.Printf("Device %s ready (major:minor = %d:%d)", dmPath, major, minor)
-		} else {
-			log.Printf("Device node %s not found: %v", dmPath, err)
 		}
 	}
+	return ""
+}
+
+// Remove removes a device-mapper device and its device nodes, like `dmsetup remove`
+func Remove(name string, log Logger) error {
+	log.Printf("Removing mapping %s", name)
+	nodes := lookupMappingNodes(name)
+	if err := removeMapping(name, false); err != nil {
+		return err
+	}
+	nodes.remove(log)
+	journalRemove(journalKindMapping, name, log)
 	return nil
 }
 
+// removeAfterFailure removes a half set up mapping and returns the error that caused it
+func removeAfterFailure(dmName string, cause error, log Logger) error {
+	nodes := lookupMappingNodes(dmName)
+	if err := removeMapping(dmName, false); err != nil {
+		log.Printf("%v", err)
+	} else {
+		nodes.remove(log)
+		journalRemove(journalKindMapping, dmName, log)
+	}
+	return cause
+}
+
+// udevWait flushes the pending device node operations, giving up when ctx is done.
+// The C call cannot be interrupted so it is left to finish in the background in that case.
+func udevWait(ctx context.Context) error {
+	done := make(chan bool, 1)
+	go func() {
+		done <- C.dm_udev_wait(C.uint32_t(0)) == 1
+	}()
+
+	select {
+	case ok := <-done:
+		if !ok {
+			return fmt.Errorf("dm_udev_wait failed")
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // CleanupMappingsForDevice removes device-mapper mappings and device nodes for a given loop device.
 func CleanupMappingsForDevice(loopDevice string, log Logger) error {
-	loopNum := getLoopNumber(loopDevice)
-	pattern := fmt.Sprintf("loop%dp", loopNum) // e.g. loop0p
+	return CleanupMappingsForDeviceContext(context.Background(), loopDevice, log)
+}
+
+// CleanupMappingsForDeviceContext is like CleanupMappingsForDevice but stops before the next mapping once ctx is done
+func CleanupMappingsForDeviceContext(ctx context.Context, loopDevice string, log Logger) error {
+	_, err := CleanupMappingsForDeviceWithOptions(ctx, loopDevice, CleanupOptions{}, log)
+	return err
+}
+
+// deviceMappings returns the names of the partition mappings created for a loop device
+func deviceMappings(loopDevice string, log Logger) ([]string, error) {
+	pattern := filepath.Base(loopDevice) + "p" // e.g. loop0p
 	mapperDir := "/dev/mapper"
 	entries, err := os.ReadDir(mapperDir)
 	if err != nil {
 		log.Printf("Failed to read %s: %v", mapperDir, err)
-		return err
+		return nil, err
 	}
 
+	var names []string
 	for _, entry := range entries {
-		name := entry.Name()
-		if strings.HasPrefix(name, pattern) {
-			mapperPath := filepath.Join(mapperDir, name)
-			// Remove symlink
-			if err := os.Remove(mapperPath); err != nil && !os.IsNotExist(err) {
-				log.Printf("Failed to remove symlink %s: %v", mapperPath, err)
-			}
-			// Remove /dev/dm-N device node
-			partNum := getPartitionNumber(name)
-			if partNum > 0 {
-				dmDevPath := fmt.Sprintf("/dev/dm-%d", partNum)
-				if err := os.Remove(dmDevPath); err != nil && !os.IsNotExist(err) {
-					log.Printf("Failed to remove device node %s: %v", dmDevPath, err)
-				}
-			}
-			// Remove device-mapper mapping using libdevmapper C API
-			dmNameC := C.CString(name)
-			taskRemove := C.dm_task_create(C.int(2)) // 2 = DeviceRemove
-			if taskRemove == nil {
-				log.Printf("dm_task_create for DeviceRemove failed for %s", name)
-			} else {
-				defer C.dm_task_destroy(taskRemove)
-				if C.dm_task_set_name(taskRemove, dmNameC) != 1 {
-					log.Printf("dm_task_set_name failed for %s", name)
-				} else if C.dm_task_run(taskRemove) != 1 {
-					log.Printf("dm_task_run (DeviceRemove) failed for %s", name)
-				} else {
-					log.Printf("Removed mapping %s", name)
-				}
-				C.free(unsafe.Pointer(dmNameC))
-			}
+		number, ok := strings.CutPrefix(entry.Name(), pattern)
+		if _, err := strconv.Atoi(number); ok && err == nil {
+			names = append(names, entry.Name())
 		}
 	}
-	return nil
+	return names, nil
 }
 
-// getLoopNumber extracts the loop device number from its path
-func getLoopNumber(device string) int {
-	base := filepath.Base(device) // "loop0"
-	numStr := strings.TrimPrefix(base, "loop")
-	num, err := strconv.Atoi(numStr)
+// mappingNodes are the device nodes createMapping may have made for a mapping. They are looked up while the
+// mapping exists, its device number tells them apart from nodes belonging to anything else.
+type mappingNodes struct {
+	name  string
+	dev   uint64
+	found bool
+}
+
+func lookupMappingNodes(name string) mappingNodes {
+	blockName, err := dmBlockName(name)
 	if err != nil {
-		return 0 // Default to 0 or handle error appropriately
+		return mappingNodes{name: name}
 	}
-	return num
+	dev, err := readDevNumber(filepath.Join("/sys/block", blockName))
+	return mappingNodes{name: name, dev: dev, found: err == nil}
+}
+
+// dmNodePath is the /dev/dm-N node of the device-mapper device with the given device number
+func dmNodePath(dev uint64) string {
+	return fmt.Sprintf("/dev/dm-%d", unix.Minor(dev))
 }
 
-// getPartitionNumber extracts the partition number from a name like loop0p1
-func getPartitionNumber(name string) int {
-	idx := strings.LastIndex(name, "p")
-	if idx == -1 || idx+1 >= len(name) {
-		return 0
+// remove unlinks the /dev/dm-N node and /dev/mapper symlink createMapping made, once the mapping is gone. Nodes
+// that point anywhere else, or at a device that took the same number since, are left alone.
+func (n mappingNodes) remove(log Logger) {
+	if !n.found {
+		return
 	}
-	partStr := name[idx+1:]
-	partNum, err := strconv.Atoi(partStr)
-	if err != nil {
-		return 0
+	dmDevPath := dmNodePath(n.dev)
+	if _, err := os.Stat(filepath.Join("/sys/block", filepath.Base(dmDevPath))); err == nil {
+		return
+	}
+	ours := isBlockNode(dmDevPath, n.dev)
+	if _, err := os.Lstat(dmDevPath); os.IsNotExist(err) {
+		ours = true
 	}
-	return partNum
+	if !ours {
+		return
+	}
+
+	mapperPath := mappingPath(n.name)
+	if target, err := os.Readlink(mapperPath); err == nil && filepath.Join(filepath.Dir(mapperPath), target) == dmDevPath {
+		if err := os.Remove(mapperPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove symlink %s: %v", mapperPath, err)
+		}
+	}
+	if err := os.Remove(dmDevPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove device node %s: %v", dmDevPath, err)
+	}
+}
+
+// isBlockNode reports whether path is a block device node for dev
+func isBlockNode(path string, dev uint64) bool {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return false
+	}
+	return st.Mode&unix.S_IFMT == unix.S_IFBLK && uint64(st.Rdev) == dev
+}
+
+// removeMapping removes a single device-mapper mapping using libdevmapper C API.
+// With deferred set a busy mapping is flagged for removal by the kernel once its last opener closes it.
+func removeMapping(name string, deferred bool) error {
+	dmNameC := C.CString(name)
+	defer C.free(unsafe.Pointer(dmNameC))
+
+	taskRemove := C.dm_task_create(C.int(C.DeviceRemove))
+	if taskRemove == nil {
+		return &DMError{Op: "remove", Call: "dm_task_create for DeviceRemove", Name: name}
+	}
+	defer C.dm_task_destroy(taskRemove)
+
+	if C.dm_task_set_name(taskRemove, dmNameC) != 1 {
+		return &DMError{Op: "remove", Call: "dm_task_set_name", Name: name}
+	}
+	if deferred && C.dm_task_deferred_remove(taskRemove) != 1 {
+		return &DMError{Op: "remove", Call: "dm_task_deferred_remove", Name: name}
+	}
+	if C.dm_task_run(taskRemove) != 1 {
+		return dmTaskError("remove", "dm_task_run (DeviceRemove)", name, taskRemove)
+	}
+	return nil
+}
+
+// dmTaskError builds a DMError for a failed dm_task_run, including the errno of the underlying ioctl
+func dmTaskError(op, call, name string, task *C.struct_dm_task) error {
+	dmErr := &DMError{Op: op, Call: call, Name: name}
+	if errno := C.dm_task_get_errno(task); errno != 0 {
+		dmErr.Err = syscall.Errno(errno)
+	}
+	return dmErr
+}
+
+// partitionMappingName returns the mapping name of a partition of a device, like loop0p1 for /dev/loop0, or
+// clonep1 for a device-mapper device such as /dev/mapper/clone
+func partitionMappingName(device string, number int) string {
+	return fmt.Sprintf("%sp%d", filepath.Base(device), number)
 }
@@ -0,0 +1,175 @@
+package loopback
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrInvalidDiskImage is returned when a VHD, VHDX or VMDK image is malformed or uses unsupported features
+var ErrInvalidDiskImage = errors.New("invalid or unsupported disk image")
+
+// Disk is the virtual disk held by an image file or a device, whatever its format
+type Disk interface {
+	io.ReaderAt
+	io.Closer
+	// Size is the size of the virtual disk in bytes
+	Size() int64
+}
+
+// rawDisk is a raw image file or block device
+type rawDisk struct {
+	*os.File
+	size int64
+}
+
+func (d *rawDisk) Size() int64 {
+	return d.size
+}
+
+// OpenDisk opens the virtual disk of an image, detecting its format: qcow2, VHD (fixed or dynamic), VHDX,
+// monolithic sparse VMDK, or raw for anything else including block devices. The format comes from the content of
+// the image, so only use it on images known to be in one of these formats: a raw disk can start with the same
+// magic bytes. GetGPTPartitions and the other functions taking a path always read it raw.
+func OpenDisk(path string) (Disk, error) {
+	raw, err := openRawDisk(path)
+	if err != nil {
+		return nil, err
+	}
+	f, size := raw.File, raw.size
+
+	magic := make([]byte, 8)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		magic = nil
+	}
+	footer := make([]byte, 8)
+	if size >= vhdFooterSize {
+		if _, err := f.ReadAt(footer, size-vhdFooterSize); err != nil {
+			footer = nil
+		}
+	}
+
+	var disk Disk
+	switch {
+	case bytes.HasPrefix(magic, []byte(qcow2Magic)):
+		f.Close()
+		return OpenQcow2(path)
+	case bytes.Equal(magic, []byte(vhdxSignature)):
+		disk, err = openVHDX(f, size)
+	case bytes.HasPrefix(magic, []byte(vmdkMagic)):
+		disk, err = openVMDK(f, size)
+	case bytes.Equal(footer, []byte(vhdCookie)):
+		disk, err = openVHD(f, size)
+	default:
+		return raw, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return disk, nil
+}
+
+// openRawDisk opens an image file or block device as is
+func openRawDisk(path string) (*rawDisk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	// Stat reports 0 for block devices, seeking to the end works for both files and devices
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("getting size of %s: %w", path, err)
+	}
+	return &rawDisk{File: f, size: size}, nil
+}
+
+// blockDisk reads an image format that splits the virtual disk into fixed-size blocks stored anywhere in the
+// file, lookup returns the file offset of a block, or -1 for a block that reads as zeroes
+type blockDisk struct {
+	*os.File
+	size      int64
+	blockSize int64
+
+	// mu serializes lookup calls, which may fill a table cache
+	mu     sync.Mutex
+	lookup func(block int64) (int64, error)
+}
+
+func (d *blockDisk) Size() int64 {
+	return d.size
+}
+
+func (d *blockDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+
+	var n int
+	for n < len(p) && off < d.size {
+		inBlock := off % d.blockSize
+		chunk := p[n : n+int(min(int64(len(p)-n), d.blockSize-inBlock, d.size-off))]
+		d.mu.Lock()
+		host, err := d.lookup(off / d.blockSize)
+		d.mu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		if host < 0 {
+			clear(chunk)
+		} else if _, err := d.File.ReadAt(chunk, host+inBlock); err != nil {
+			return n, fmt.Errorf("reading block at %d: %w", host, err)
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ConvertToRaw writes a virtual disk to a sparse raw file that Loop can attach, zero blocks become holes
+func ConvertToRaw(d Disk, dst string) error {
+	return writeSparseRaw(d, d.Size(), dst)
+}
+
+// writeSparseRaw copies size bytes from r into a new file at dst, skipping all-zero blocks so they stay holes
+func writeSparseRaw(r io.ReaderAt, size int64, dst string) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", dst, err)
+	}
+
+	const blockSize = 64 << 10
+	buf := make([]byte, blockSize)
+	zero := make([]byte, blockSize)
+	for off := int64(0); off < size && err == nil; off += blockSize {
+		chunk := buf[:min(blockSize, size-off)]
+		if _, err = r.ReadAt(chunk, off); err != nil && err != io.EOF {
+			break
+		}
+		err = nil
+		if !bytes.Equal(chunk, zero[:len(chunk)]) {
+			_, err = out.WriteAt(chunk, off)
+		}
+	}
+	if err == nil {
+		err = out.Truncate(size)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("writing %s: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package loopback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDiskBlock is the block size of the VHD and VHDX test images
+const testDiskBlock = 1 << 20
+
+// buildTestDisk returns a 6MiB raw disk, the MBR test disk followed by an empty block and a block of data
+func buildTestDisk() []byte {
+	img := append(buildTestMBR(), make([]byte, 2*testDiskBlock)...)
+	for off := 5 * testDiskBlock; off < len(img); off += 4096 {
+		copy(img[off+100:], "data")
+	}
+	return img
+}
+
+func putVHDChecksum(b []byte, off int) {
+	var sum uint32
+	for i, c := range b {
+		if i < off || i >= off+4 {
+			sum += uint32(c)
+		}
+	}
+	binary.BigEndian.PutUint32(b[off:], ^sum)
+}
+
+func vhdFooter(diskType uint32, size, dataOffset uint64) []byte {
+	footer := make([]byte, vhdFooterSize)
+	copy(footer, vhdCookie)
+	binary.BigEndian.PutUint32(footer[12:], 0x00010000)
+	binary.BigEndian.PutUint64(footer[16:], dataOffset)
+	binary.BigEndian.PutUint64(footer[40:], size)
+	binary.BigEndian.PutUint64(footer[48:], size)
+	binary.BigEndian.PutUint32(footer[60:], diskType)
+	putVHDChecksum(footer, 64)
+	return footer
+}
+
+func buildFixedVHD(raw []byte) []byte {
+	return append(append([]byte{}, raw...), vhdFooter(vhdTypeFixed, uint64(len(raw)), ^uint64(0))...)
+}
+
+func buildDynamicVHD(raw []byte) []byte {
+	blocks := len(raw) / testDiskBlock
+	footer := vhdFooter(vhdTypeDynamic, uint64(len(raw)), vhdFooterSize)
+	img := append([]byte{}, footer...)
+
+	hdr := make([]byte, vhdDynamicSize)
+	copy(hdr, vhdDynamicCookie)
+	binary.BigEndian.PutUint64(hdr[8:], ^uint64(0))
+	binary.BigEndian.PutUint64(hdr[16:], vhdFooterSize+vhdDynamicSize)
+	binary.BigEndian.PutUint32(hdr[24:], 0x00010000)
+	binary.BigEndian.PutUint32(hdr[28:], uint32(blocks))
+	binary.BigEndian.PutUint32(hdr[32:], testDiskBlock)
+	putVHDChecksum(hdr, 36)
+	img = append(img, hdr...)
+
+	bat := bytes.Repeat([]byte{0xff}, sectorSize)
+	img = append(img, bat...)
+	for i := 0; i < blocks; i++ {
+		block := raw[i*testDiskBlock : (i+1)*testDiskBlock]
+		if !bytes.Equal(block, make([]byte, testDiskBlock)) {
+			binary.BigEndian.PutUint32(img[vhdFooterSize+vhdDynamicSize+4*i:], uint32(len(img)/sectorSize))
+			img = append(img, bytes.Repeat([]byte{0xff}, sectorSize)...)
+			img = append(img, block...)
+		}
+	}
+	return append(img, footer...)
+}
+
+// guidBytes encodes a GUID string in its on-disk mixed-endian form
+func guidBytes(s string) []byte {
+	b, _ := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+func putVHDXChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, vhdxCRC))
+}
+
+// buildVHDX lays out a dynamic VHDX: headers and region tables in the first MiB, metadata in the second, the
+// block allocation table in the third and the payload blocks after it
+func buildVHDX(raw []byte) []byte {
+	const metaOffset, batOffset = 1 << 20, 2 << 20
+	img := make([]byte, 3<<20)
+	copy(img, vhdxSignature)
+
+	for i, off := range []int{64 << 10, 128 << 10} {
+		hdr := img[off : off+vhdxHeaderSize]
+		copy(hdr, "head")
+		binary.LittleEndian.PutUint64(hdr[8:], uint64(i+1))
+		binary.LittleEndian.PutUint16(hdr[66:], 1)
+		putVHDXChecksum(hdr)
+	}
+	for _, off := range []int{192 << 10, 256 << 10} {
+		table := img[off : off+vhdxRegionTableSize]
+		copy(table, "regi")
+		binary.LittleEndian.PutUint32(table[8:], 2)
+		copy(table[16:], guidBytes(vhdxRegionBAT))
+		binary.LittleEndian.PutUint64(table[32:], batOffset)
+		binary.LittleEndian.PutUint32(table[40:], 1<<20)
+		copy(table[48:], guidBytes(vhdxRegionMetadata))
+		binary.LittleEndian.PutUint64(table[64:], metaOffset)
+		binary.LittleEndian.PutUint32(table[72:], 1<<20)
+		putVHDXChecksum(table)
+	}
+
+	meta := img[metaOffset:]
+	copy(meta, "metadata")
+	binary.LittleEndian.PutUint16(meta[10:], 3)
+	items := []struct {
+		guid  string
+		value []byte
+	}{
+		{vhdxMetaFileParameters, binary.LittleEndian.AppendUint32(make([]byte, 4), 0)},
+		{vhdxMetaVirtualDiskSize, binary.LittleEndian.AppendUint64(nil, uint64(len(raw)))},
+		{vhdxMetaLogicalSectorSize, binary.LittleEndian.AppendUint32(nil, sectorSize)},
+	}
+	binary.LittleEndian.PutUint32(items[0].value, testDiskBlock)
+	for i, item := range items {
+		entry := meta[32+i*32:]
+		copy(entry, guidBytes(item.guid))
+		binary.LittleEndian.PutUint32(entry[16:], uint32(64<<10+i*8))
+		binary.LittleEndian.PutUint32(entry[20:], uint32(len(item.value)))
+		copy(meta[64<<10+i*8:], item.value)
+	}
+
+	for i := 0; i < len(raw)/testDiskBlock; i++ {
+		block := raw[i*testDiskBlock : (i+1)*testDiskBlock]
+		if !bytes.Equal(block, make([]byte, testDiskBlock)) {
+			binary.LittleEndian.PutUint64(img[batOffset+8*i:], uint64(len(img))|vhdxBlockFullyPresent)
+			img = append(img, block...)
+		}
+	}
+	return img
+}
+
+// buildVMDK lays out a monolithic sparse VMDK with 64KiB grains: the header, the grain directory at sector 1,
+// the grain tables at sector 2 and the grains after them
+func buildVMDK(raw []byte) []byte {
+	const grainSectors, gtEntries = 128, 512
+	grains := len(raw) / (grainSectors * sectorSize)
+	tables := (grains + gtEntries - 1) / gtEntries
+	grainsStart := 2 + tables*gtEntries*4/sectorSize
+
+	img := make([]byte, grainsStart*sectorSize)
+	copy(img, vmdkMagic)
+	binary.LittleEndian.PutUint32(img[4:], 1)
+	binary.LittleEndian.PutUint32(img[8:], 3)
+	binary.LittleEndian.PutUint64(img[12:], uint64(len(raw)/sectorSize))
+	binary.LittleEndian.PutUint64(img[20:], grainSectors)
+	binary.LittleEndian.PutUint32(img[44:], gtEntries)
+	binary.LittleEndian.PutUint64(img[56:], 1)
+	binary.LittleEndian.PutUint64(img[64:], uint64(grainsStart))
+	for i := 0; i < tables; i++ {
+		binary.LittleEndian.PutUint32(img[sectorSize+4*i:], uint32(2+i*gtEntries*4/sectorSize))
+	}
+
+	for i := 0; i < grains; i++ {
+		grain := raw[i*grainSectors*sectorSize : (i+1)*grainSectors*sectorSize]
+		entry := 2*sectorSize + 4*i
+		switch {
+		case i%2 == 1 && bytes.Equal(grain, make([]byte, len(grain))):
+			binary.LittleEndian.PutUint32(img[entry:], vmdkGrainZero)
+		case !bytes.Equal(grain, make([]byte, len(grain))):
+			binary.LittleEndian.PutUint32(img[entry:], uint32(len(img)/sectorSize))
+			img = append(img, grain...)
+		}
+	}
+	return img
+}
+
+func TestOpenDiskFormats(t *testing.T) {
+	raw := buildTestDisk()
+	dir := t.TempDir()
+
+	formats := map[string][]byte{
+		"disk.raw":  raw,
+		"fixed.vhd": buildFixedVHD(raw),
+		"dyn.vhd":   buildDynamicVHD(raw),
+		"disk.vhdx": buildVHDX(raw),
+		"disk.vmdk": buildVMDK(raw),
+	}
+	for name, img := range formats {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, img, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := OpenDisk(path)
+			if err != nil {
+				t.Fatalf("OpenDisk() failed: %v", err)
+			}
+			defer d.Close()
+
+			if d.Size() != int64(len(raw)) {
+				t.Fatalf("Expected a %d bytes disk, got %d", len(raw), d.Size())
+			}
+			got := make([]byte, len(raw))
+			if _, err := d.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt() failed: %v", err)
+			}
+			if !bytes.Equal(got, raw) {
+				t.Fatalf("Virtual disk content mismatch")
+			}
+			// A read crossing blocks
+			if _, err := d.ReadAt(got[:100], 5*testDiskBlock-50); err != nil || !bytes.Equal(got[:100], raw[5*testDiskBlock-50:5*testDiskBlock+50]) {
+				t.Fatalf("Unaligned read mismatch: %v", err)
+			}
+
+			parts, err := ReadMBRPartitions(d, d.Size())
+			if err != nil || len(parts) != 3 {
+				t.Fatalf("ReadMBRPartitions() returned %+v, %v", parts, err)
+			}
+			if fs, err := ProbeDiskPartition(d, parts[0]); err != nil || fs.Type != "squashfs" {
+				t.Fatalf("ProbeDiskPartition() returned %+v, %v", fs, err)
+			}
+			if _, err := ReadGPTPartitions(d, d.Size()); !errors.Is(err, ErrNoGPT) {
+				t.Fatalf("Expected ErrNoGPT, got %v", err)
+			}
+
+			converted := filepath.Join(t.TempDir(), "disk.raw")
+			if err := ConvertToRaw(d, converted); err != nil {
+				t.Fatalf("ConvertToRaw() failed: %v", err)
+			}
+			if b, err := os.ReadFile(converted); err != nil || !bytes.Equal(b, raw) {
+				t.Fatalf("Raw conversion mismatch: %v", err)
+			}
+		})
+	}
+}
+
+func TestPathFunctionsReadRaw(t *testing.T) {
+	dir := t.TempDir()
+	// Boot code is free to hold the magic bytes of an image format, it must not change how the disk is read
+	mbr := buildTestDisk()
+	copy(mbr, qcow2Magic)
+	gpt := buildTestGPT(2048, 128, 128, testGPTEntry{firstLBA: 34, lastLBA: 999, name: "boot"})
+	copy(gpt, vhdxSignature)
+	copy(gpt[len(gpt)-vhdFooterSize:], vhdCookie)
+
+	mbrPath := filepath.Join(dir, "mbr.img")
+	gptPath := filepath.Join(dir, "gpt.img")
+	os.WriteFile(mbrPath, mbr, 0o644)
+	os.WriteFile(gptPath, gpt, 0o644)
+
+	parts, err := GetMBRPartitions(mbrPath)
+	if err != nil || len(parts) != 3 {
+		t.Fatalf("GetMBRPartitions() returned %+v, %v", parts, err)
+	}
+	if fs, err := ProbePartition(mbrPath, parts[0]); err != nil || fs.Type != "squashfs" {
+		t.Fatalf("ProbePartition() returned %+v, %v", fs, err)
+	}
+	if parts, err := GetGPTPartitions(gptPath); err != nil || len(parts) != 1 || parts[0].Name != "boot" {
+		t.Fatalf("GetGPTPartitions() returned %+v, %v", parts, err)
+	}
+}
+
+func TestOpenDiskRejectsCorruptImages(t *testing.T) {
+	raw := buildTestDisk()
+
+	vhd := buildDynamicVHD(raw)
+	vhd[len(vhd)-1] ^= 0xff
+	vhdx := buildVHDX(raw)
+	for _, off := range []int{64 << 10, 128 << 10} {
+		vhdx[off+48] = 1
+		putVHDXChecksum(vhdx[off : off+vhdxHeaderSize])
+	}
+	// Region table fields are only vouched for by their checksum, none of these may be allocated or read
+	vhdxRegion := func(field int, value func(img []byte) uint64) []byte {
+		img := buildVHDX(raw)
+		for _, off := range []int{192 << 10, 256 << 10} {
+			if field == 40 || field == 72 {
+				binary.LittleEndian.PutUint32(img[off+field:], uint32(value(img)))
+			} else {
+				binary.LittleEndian.PutUint64(img[off+field:], value(img))
+			}
+			putVHDXChecksum(img[off : off+vhdxRegionTableSize])
+		}
+		return img
+	}
+	fixed := func(v uint64) func([]byte) uint64 { return func([]byte) uint64 { return v } }
+	vmdk := buildVMDK(raw)
+	binary.LittleEndian.PutUint32(vmdk[8:], vmdkFlagCompressed)
+
+	for name, img := range map[string][]byte{
+		"vhd checksum":         vhd,
+		"vhdx log":             vhdx,
+		"vhdx metadata length": vhdxRegion(72, fixed(1<<30)),
+		"vhdx metadata offset": vhdxRegion(64, fixed(1<<40)),
+		"vhdx metadata past end": vhdxRegion(64, func(img []byte) uint64 {
+			return uint64(len(img) - 64<<10)
+		}),
+		"vhdx bat offset": vhdxRegion(32, fixed(1<<40)),
+		"vmdk compressed": vmdk,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk")
+			if err := os.WriteFile(path, img, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenDisk(path); !errors.Is(err, ErrInvalidDiskImage) {
+				t.Fatalf("Expected ErrInvalidDiskImage, got %v", err)
+			}
+		})
+	}
+}
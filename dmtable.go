@@ -0,0 +1,43 @@
+package loopback
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidTable is returned when a device-mapper table is rejected before reaching the kernel
+var ErrInvalidTable = errors.New("invalid device-mapper table")
+
+// Target is a single segment of a device-mapper table, start and length are in 512 bytes sectors
+type Target struct {
+	Start  uint64
+	Length uint64
+	Type   string
+	Params string
+}
+
+// String formats the target as a `dmsetup table` line
+func (t Target) String() string {
+	return fmt.Sprintf("%d %d %s %s", t.Start, t.Length, t.Type, t.Params)
+}
+
+// validateTable checks a table is not empty and its targets follow each other from sector 0 without gaps
+func validateTable(targets []Target) error {
+	if len(targets) == 0 {
+		return fmt.Errorf("%w: no targets", ErrInvalidTable)
+	}
+	var next uint64
+	for i, t := range targets {
+		if t.Type == "" {
+			return fmt.Errorf("%w: target %d has no type", ErrInvalidTable, i)
+		}
+		if t.Length == 0 {
+			return fmt.Errorf("%w: target %d is empty", ErrInvalidTable, i)
+		}
+		if t.Start != next {
+			return fmt.Errorf("%w: target %d starts at sector %d instead of %d", ErrInvalidTable, i, t.Start, next)
+		}
+		next = t.Start + t.Length
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package loopback
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []Target
+		wantErr bool
+	}{
+		{"single", []Target{{Length: 8, Type: "zero"}}, false},
+		{"contiguous", []Target{{Length: 8, Type: "linear", Params: "/dev/loop0 0"}, {Start: 8, Length: 8, Type: "error"}}, false},
+		{"empty", nil, true},
+		{"gap", []Target{{Length: 8, Type: "zero"}, {Start: 16, Length: 8, Type: "zero"}}, true},
+		{"not from zero", []Target{{Start: 1, Length: 8, Type: "zero"}}, true},
+		{"no length", []Target{{Type: "zero"}}, true},
+		{"no type", []Target{{Length: 8}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTable(tt.targets)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validateTable() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidTable) {
+				t.Fatalf("Expected ErrInvalidTable, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTargetString(t *testing.T) {
+	target := Target{Start: 8, Length: 2048, Type: "linear", Params: "/dev/loop0 34"}
+	if got := target.String(); got != "8 2048 linear /dev/loop0 34" {
+		t.Fatalf("Unexpected table line %q", got)
+	}
+}
@@ -0,0 +1,71 @@
+package loopback
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	// ErrImageInUse is returned when the image is already attached to a loop device, see ImageInUseError
+	ErrImageInUse = errors.New("image file is already in use by another loop device")
+	// ErrNoGPT is returned when a device or image has no GPT
+	ErrNoGPT = errors.New("invalid or missing GPT signature")
+	// ErrNoMBR is returned when a device or image has no MBR partition table, or only the protective MBR of a GPT
+	ErrNoMBR = errors.New("invalid or missing MBR signature")
+	// ErrNoFreeLoop is returned when the kernel has no free loop device to hand out
+	ErrNoFreeLoop = errors.New("no free loop device")
+	// ErrPermission matches any failure caused by missing privileges, including EPERM and EACCES from syscalls
+	ErrPermission = os.ErrPermission
+)
+
+// ImageInUseError is returned by Loop when the image is already attached, Device is the loop device holding it
+type ImageInUseError struct {
+	Image  string
+	Device string
+}
+
+func (e *ImageInUseError) Error() string {
+	return fmt.Sprintf("image file %s is already in use by loop device %s", e.Image, e.Device)
+}
+
+func (e *ImageInUseError) Is(target error) bool {
+	return target == ErrImageInUse
+}
+
+// DMError is returned when a device-mapper operation fails
+type DMError struct {
+	// Op is the libdevmapper task that failed: create, reload, suspend, resume, message, table, status, list or remove
+	Op string
+	// Call is the libdevmapper call that failed
+	Call string
+	// Name is the mapping name, empty for calls not tied to a mapping like listing them
+	Name string
+	// Err is the errno reported by the kernel, nil if the failure happened before reaching it
+	Err error
+}
+
+func (e *DMError) Error() string {
+	msg := e.Call + " failed"
+	if e.Name != "" {
+		msg += " for " + e.Name
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+func (e *DMError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err is a transient failure, like a busy device or a race for a free loop device,
+// that may succeed if the operation is tried again
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrNoFreeLoop) ||
+		errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR)
+}
@@ -0,0 +1,60 @@
+package loopback
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestErrorsIsAs(t *testing.T) {
+	var err error = &ImageInUseError{Image: "/tmp/disk.img", Device: "/dev/loop3"}
+	err = fmt.Errorf("attaching: %w", err)
+	if !errors.Is(err, ErrImageInUse) {
+		t.Fatalf("Expected %v to match ErrImageInUse", err)
+	}
+	var inUse *ImageInUseError
+	if !errors.As(err, &inUse) || inUse.Device != "/dev/loop3" {
+		t.Fatalf("Expected the existing device to be available, got %+v", inUse)
+	}
+
+	err = &DMError{Op: "remove", Call: "dm_task_run (DeviceRemove)", Name: "loop0p1", Err: syscall.EBUSY}
+	var dmErr *DMError
+	if !errors.As(err, &dmErr) || dmErr.Op != "remove" {
+		t.Fatalf("Expected a *DMError, got %T", err)
+	}
+	if !IsRetryable(err) {
+		t.Fatalf("Expected a busy mapping to be retryable")
+	}
+
+	if !errors.Is(syscall.EPERM, ErrPermission) || !errors.Is(syscall.EACCES, ErrPermission) {
+		t.Fatalf("Expected EPERM and EACCES to match ErrPermission")
+	}
+	if IsRetryable(ErrNoGPT) {
+		t.Fatalf("Expected ErrNoGPT to not be retryable")
+	}
+}
+
+func TestReadGPTPartitionsNoGPT(t *testing.T) {
+	img := make([]byte, 4096)
+	if _, err := ReadGPTPartitions(bytes.NewReader(img), int64(len(img))); !errors.Is(err, ErrNoGPT) {
+		t.Fatalf("Expected ErrNoGPT for a blank image, got %v", err)
+	}
+	if _, err := ReadGPTPartitions(bytes.NewReader(img[:512]), 512); !errors.Is(err, ErrNoGPT) {
+		t.Fatalf("Expected ErrNoGPT for a tiny image, got %v", err)
+	}
+}
+
+func TestGetFreeError(t *testing.T) {
+	exhausted := getFreeError(&IoctlError{Device: "/dev/loop-control", Request: "LOOP_CTL_GET_FREE", Err: syscall.ENOSPC})
+	if !errors.Is(exhausted, ErrNoFreeLoop) || !IsRetryable(exhausted) {
+		t.Fatalf("Expected running out of loop devices to match ErrNoFreeLoop, got %v", exhausted)
+	}
+	for _, errno := range []syscall.Errno{syscall.EPERM, syscall.ENODEV} {
+		err := getFreeError(&IoctlError{Device: "/dev/loop-control", Request: "LOOP_CTL_GET_FREE", Err: errno})
+		if errors.Is(err, ErrNoFreeLoop) || IsRetryable(err) || !errors.Is(err, errno) {
+			t.Fatalf("Expected %v to be passed through as not retryable, got %v", errno, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SectorRange is a range of 512 bytes sectors
+type SectorRange struct {
+	Start  uint64
+	Length uint64
+}
+
+// FlakeyOptions configures the dm-flakey target: the device works for Up, then misbehaves for Down, in a loop
+type FlakeyOptions struct {
+	// Up and Down are rounded down to whole seconds, at least one of them must be a second or more
+	Up   time.Duration
+	Down time.Duration
+	// DropWrites silently drops writes while down instead of failing all I/O
+	DropWrites bool
+	// ErrorWrites fails writes while down but lets reads through
+	ErrorWrites bool
+}
+
+// FaultyDisk is a device-mapper device wrapping a block device, whose faults can be switched at runtime.
+// It starts healthy, passing all I/O through.
+type FaultyDisk struct {
+	name    string
+	device  string
+	sectors uint64
+	// loop is the loop device attached by NewFaultyImage, detached on Close
+	loop string
+	log  Logger
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewFaultyDisk wraps device, like a loop device returned by Loop, in a mapping called name
+func NewFaultyDisk(ctx context.Context, device, name string, log Logger) (*FaultyDisk, error) {
+	sectors, err := deviceSectors(device)
+	if err != nil {
+		return nil, err
+	}
+	d := &FaultyDisk{name: name, device: device, sectors: sectors, log: log}
+	if err := dmCreate(ctx, dmDevice{Name: name, Targets: d.healthyTable(), Backing: device}, log); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewFaultyImage attaches img to a loop device with opts and wraps it in a mapping called name.
+// Close detaches the loop device as well.
+func NewFaultyImage(ctx context.Context, img, name string, opts LoopOptions, log Logger) (*FaultyDisk, error) {
+	loopDevice, err := LoopWithOptions(ctx, img, opts, log)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewFaultyDisk(ctx, loopDevice, name, log)
+	if err != nil {
+		if unloopErr := Unloop(loopDevice, log); unloopErr != nil {
+			log.Printf("%v", unloopErr)
+		}
+		return nil, err
+	}
+	d.loop = loopDevice
+	return d, nil
+}
+
+// Path returns the /dev/mapper path of the faulty disk
+func (d *FaultyDisk) Path() string {
+	return mappingPath(d.name)
+}
+
+// Device returns the wrapped block device
+func (d *FaultyDisk) Device() string {
+	return d.device
+}
+
+func (d *FaultyDisk) healthyTable() []Target {
+	return []Target{{Length: d.sectors, Type: "linear", Params: d.device + " 0"}}
+}
+
+// Healthy switches the faults off, passing all I/O through again
+func (d *FaultyDisk) Healthy() error {
+	return d.switchTable("healthy", d.healthyTable())
+}
+
+// Fail makes every I/O on the disk fail
+func (d *FaultyDisk) Fail() error {
+	return d.switchTable("failing", []Target{{Length: d.sectors, Type: "error"}})
+}
+
+// FailRanges makes I/O fail on the given ranges only, the rest of the disk keeps working
+func (d *FaultyDisk) FailRanges(ranges []SectorRange) error {
+	table, err := errorRangeTable(d.device, d.sectors, ranges)
+	if err != nil {
+		return err
+	}
+	return d.switchTable(fmt.Sprintf("failing on %d ranges", len(ranges)), table)
+}
+
+// Flakey makes the disk alternate between working and failing, see FlakeyOptions
+func (d *FaultyDisk) Flakey(opts FlakeyOptions) error {
+	params, err := flakeyParams(d.device, opts)
+	if err != nil {
+		return err
+	}
+	return d.switchTable("flakey", []Target{{Length: d.sectors, Type: "flakey", Params: params}})
+}
+
+// Delay delays reads and writes by the given latencies, rounded down to milliseconds
+func (d *FaultyDisk) Delay(read, write time.Duration) error {
+	// <device> <offset> <delay> [<write_device> <write_offset> <write_delay>]
+	params := fmt.Sprintf("%s 0 %d %s 0 %d", d.device, read.Milliseconds(), d.device, write.Milliseconds())
+	return d.switchTable("delayed", []Target{{Length: d.sectors, Type: "delay", Params: params}})
+}
+
+// switchTable swaps the live table, I/O in flight completes against the previous one
+func (d *FaultyDisk) switchTable(state string, table []Target) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return fmt.Errorf("faulty disk %s is closed", d.name)
+	}
+	d.log.Printf("Switching %s to %s", d.name, state)
+	return dmReplaceTable(d.name, table)
+}
+
+// Close removes the mapping, along with the ones stacked on it, and detaches the loop device attached by
+// NewFaultyImage. Calling Close again is a no-op.
+func (d *FaultyDisk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	var errs []error
+	if err := removeMappingStack(d.name, d.log); err != nil {
+		errs = append(errs, err)
+	}
+	if d.loop != "" {
+		if err := Unloop(d.loop, d.log); err != nil {
+			errs = append(errs, fmt.Errorf("detaching %s: %w", d.loop, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flakeyParams builds the flakey target parameters for a device
+func flakeyParams(device string, opts FlakeyOptions) (string, error) {
+	up, down := uint64(opts.Up/time.Second), uint64(opts.Down/time.Second)
+	if up+down == 0 {
+		return "", fmt.Errorf("flakey up and down intervals are both under a second")
+	}
+	if opts.DropWrites && opts.ErrorWrites {
+		return "", fmt.Errorf("flakey DropWrites and ErrorWrites are mutually exclusive")
+	}
+
+	// <dev path> <offset> <up interval> <down interval> [<num_features> [<feature arguments>]]
+	params := fmt.Sprintf("%s 0 %d %d", device, up, down)
+	switch {
+	case opts.DropWrites:
+		params += " 1 drop_writes"
+	case opts.ErrorWrites:
+		params += " 1 error_writes"
+	}
+	return params, nil
+}
+
+// errorRangeTable builds a table passing I/O through to device except on the given ranges, which are backed
+// by the error target. Overlapping ranges are merged.
+func errorRangeTable(device string, sectors uint64, ranges []SectorRange) ([]Target, error) {
+	sorted := make([]SectorRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Length == 0 {
+			continue
+		}
+		if r.Start >= sectors || r.Length > sectors-r.Start {
+			return nil, fmt.Errorf("error range [%d, +%d) is outside the %d sectors of %s", r.Start, r.Length, sectors, device)
+		}
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var table []Target
+	var pos uint64
+	for _, r := range sorted {
+		end := r.Start + r.Length
+		if end <= pos {
+			continue
+		}
+		if r.Start > pos {
+			table = append(table, Target{Start: pos, Length: r.Start - pos, Type: "linear", Params: fmt.Sprintf("%s %d", device, pos)})
+		} else if len(table) > 0 && table[len(table)-1].Type == "error" {
+			// Overlaps the previous range, extend it
+			table[len(table)-1].Length = end - table[len(table)-1].Start
+			pos = end
+			continue
+		}
+		start := max(r.Start, pos)
+		table = append(table, Target{Start: start, Length: end - start, Type: "error"})
+		pos = end
+	}
+	if pos < sectors {
+		table = append(table, Target{Start: pos, Length: sectors - pos, Type: "linear", Params: fmt.Sprintf("%s %d", device, pos)})
+	}
+	return table, nil
+}
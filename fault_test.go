@@ -0,0 +1,43 @@
+package loopback
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestErrorRangeTable(t *testing.T) {
+	table, err := errorRangeTable("/dev/loop0", 100, []SectorRange{{Start: 50, Length: 10}, {Start: 0, Length: 8}, {Start: 55, Length: 10}})
+	if err != nil {
+		t.Fatalf("errorRangeTable() failed: %v", err)
+	}
+	want := []Target{
+		{Start: 0, Length: 8, Type: "error"},
+		{Start: 8, Length: 42, Type: "linear", Params: "/dev/loop0 8"},
+		{Start: 50, Length: 15, Type: "error"},
+		{Start: 65, Length: 35, Type: "linear", Params: "/dev/loop0 65"},
+	}
+	if !reflect.DeepEqual(table, want) {
+		t.Fatalf("Unexpected table:\n got %v\nwant %v", table, want)
+	}
+	if err := validateTable(table); err != nil {
+		t.Fatalf("Table is not contiguous: %v", err)
+	}
+
+	if _, err := errorRangeTable("/dev/loop0", 100, []SectorRange{{Start: 90, Length: 20}}); err == nil {
+		t.Fatal("Expected an error for a range past the end of the device")
+	}
+}
+
+func TestFlakeyParams(t *testing.T) {
+	params, err := flakeyParams("/dev/loop0", FlakeyOptions{Up: 5 * time.Second, Down: time.Second, ErrorWrites: true})
+	if err != nil || params != "/dev/loop0 0 5 1 1 error_writes" {
+		t.Fatalf("flakeyParams() = %q, %v", params, err)
+	}
+	if _, err := flakeyParams("/dev/loop0", FlakeyOptions{Up: time.Millisecond}); err == nil {
+		t.Fatal("Expected an error for sub-second intervals")
+	}
+	if _, err := flakeyParams("/dev/loop0", FlakeyOptions{Up: time.Second, DropWrites: true, ErrorWrites: true}); err == nil {
+		t.Fatal("Expected an error for conflicting features")
+	}
+}
@@ -2,4 +2,9 @@ module github.com/itxaka/loopback
 
 go 1.24
 
-require golang.org/x/sys v0.33.0
\ No newline at end of file
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/crypto v0.39.0
+	golang.org/x/sys v0.33.0
+)
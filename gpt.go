@@ -3,55 +3,150 @@ package loopback
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"sort"
 )
 
+const (
+	// gptHeaderMinSize is the size of the fields defined by the UEFI spec, the rest of the header sector is reserved
+	gptHeaderMinSize = 92
+	// gptEntryMinSize is the minimum size of a partition entry, it must be 128 * 2^n
+	gptEntryMinSize = 128
+	// gptMaxEntryArraySize caps the partition entry array we are willing to read from an untrusted header
+	gptMaxEntryArraySize = 1 << 20
+)
+
+var (
+	// ErrInvalidGPTHeader is returned when the GPT header contains values outside what the spec or the device allow
+	ErrInvalidGPTHeader = errors.New("invalid GPT header")
+	// ErrInvalidPartition is returned when a GPT partition entry is out of range or overlaps another one
+	ErrInvalidPartition = errors.New("invalid GPT partition entry")
+)
+
+// GPTError describes which part of the GPT failed validation and why
+type GPTError struct {
+	// Partition is the 1-based entry number at fault, 0 when the header itself is invalid
+	Partition int
+	Reason    string
+	Err       error
+}
+
+func (e *GPTError) Error() string {
+	if e.Partition > 0 {
+		return fmt.Sprintf("%v %d: %s", e.Err, e.Partition, e.Reason)
+	}
+	return fmt.Sprintf("%v: %s", e.Err, e.Reason)
+}
+
+func (e *GPTError) Unwrap() error {
+	return e.Err
+}
+
+func headerError(format string, args ...interface{}) error {
+	return &GPTError{Reason: fmt.Sprintf(format, args...), Err: ErrInvalidGPTHeader}
+}
+
+func partitionError(number int, format string, args ...interface{}) error {
+	return &GPTError{Partition: number, Reason: fmt.Sprintf(format, args...), Err: ErrInvalidPartition}
+}
+
 type Partition struct {
-	Number     int
-	Name       string
+	Number int
+	Name   string
+	// TypeGUID is the partition type GUID, UUID is the unique partition GUID, both lower case
+	TypeGUID string
+	UUID     string
+	// MBRType is the partition type byte of MBR partitions, 0 for GPT partitions
+	MBRType    uint8
 	FirstLBA   uint64
 	LastLBA    uint64
 	NumSectors uint64
+	// Filesystem is what the partition holds, nil if no known superblock was found
+	Filesystem *Filesystem
 }
 
+// GetGPTPartitions reads the GPT of a device or raw image file. For the virtual disk of a qcow2, VHD, VHDX or
+// VMDK image, open it with OpenDisk and use ReadGPTPartitions.
 func GetGPTPartitions(devicePath string) ([]Partition, error) {
-	f, err := os.Open(devicePath)
+	disk, err := openRawDisk(devicePath)
 	if err != nil {
-		return nil, fmt.Errorf("open %s: %w", devicePath, err)
+		return nil, err
 	}
-	defer f.Close()
+	defer disk.Close()
+
+	return ReadGPTPartitions(disk, disk.Size())
+}
+
+// ReadGPTPartitions parses and validates the primary GPT found in r, which is size bytes long. It reads from
+// anything addressable, like an in-memory buffer, a Disk opened with OpenDisk or an HTTP range reader, so
+// partitions can be inspected without root or a loop device.
+func ReadGPTPartitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	if size < 2*sectorSize {
+		return nil, fmt.Errorf("%w, device too small to hold a GPT (%d bytes)", ErrNoGPT, size)
+	}
+	totalSectors := uint64(size) / sectorSize
 
 	// Read GPT header at sector 1
 	hdrBuf := make([]byte, sectorSize)
-	if _, err := f.ReadAt(hdrBuf, sectorSize); err != nil {
+	if _, err := r.ReadAt(hdrBuf, sectorSize); err != nil {
 		return nil, fmt.Errorf("reading GPT header: %w", err)
 	}
 
 	// Check for valid GPT signature "EFI PART"
 	expectedSignature := []byte{'E', 'F', 'I', ' ', 'P', 'A', 'R', 'T'}
 	if !bytes.Equal(hdrBuf[:8], expectedSignature) {
-		return nil, fmt.Errorf("invalid or missing GPT signature, not a GPT disk or blank image")
+		return nil, fmt.Errorf("%w, not a GPT disk or blank image", ErrNoGPT)
 	}
 
+	headerSize := binary.LittleEndian.Uint32(hdrBuf[12:16])
+	firstUsableLBA := binary.LittleEndian.Uint64(hdrBuf[40:48])
+	lastUsableLBA := binary.LittleEndian.Uint64(hdrBuf[48:56])
 	partitionEntryLBA := binary.LittleEndian.Uint64(hdrBuf[72:80])
 	numPartitionEntries := binary.LittleEndian.Uint32(hdrBuf[80:84])
 	sizeOfPartitionEntry := binary.LittleEndian.Uint32(hdrBuf[84:88])
 
 	// Validate that the values are reasonable
 	if partitionEntryLBA == 0 || numPartitionEntries == 0 || sizeOfPartitionEntry == 0 {
-		return nil, fmt.Errorf("invalid GPT header values: partitionEntryLBA=%d, numPartitionEntries=%d, sizeOfPartitionEntry=%d",
+		return nil, headerError("partitionEntryLBA=%d, numPartitionEntries=%d, sizeOfPartitionEntry=%d",
 			partitionEntryLBA, numPartitionEntries, sizeOfPartitionEntry)
 	}
+	if headerSize < gptHeaderMinSize || headerSize > sectorSize {
+		return nil, headerError("header size %d out of range [%d, %d]", headerSize, gptHeaderMinSize, sectorSize)
+	}
+	if sizeOfPartitionEntry < gptEntryMinSize || sizeOfPartitionEntry%gptEntryMinSize != 0 ||
+		!isPowerOfTwo(sizeOfPartitionEntry/gptEntryMinSize) {
+		return nil, headerError("partition entry size %d is not 128 * 2^n", sizeOfPartitionEntry)
+	}
+
+	// Both values are uint32 so the product fits in a uint64 without overflowing
+	arraySize := uint64(numPartitionEntries) * uint64(sizeOfPartitionEntry)
+	if arraySize > gptMaxEntryArraySize {
+		return nil, headerError("partition entry array of %d bytes exceeds the %d bytes limit", arraySize, gptMaxEntryArraySize)
+	}
+	arraySectors := (arraySize + sectorSize - 1) / sectorSize
+
+	// The array sits after the protective MBR and the header and must end inside the device
+	if partitionEntryLBA < 2 || partitionEntryLBA > totalSectors || arraySectors > totalSectors-partitionEntryLBA {
+		return nil, headerError("partition entry array at LBA %d (%d sectors) is outside the device (%d sectors)",
+			partitionEntryLBA, arraySectors, totalSectors)
+	}
+	if firstUsableLBA > lastUsableLBA || lastUsableLBA >= totalSectors {
+		return nil, headerError("usable LBA range [%d, %d] is outside the device (%d sectors)",
+			firstUsableLBA, lastUsableLBA, totalSectors)
+	}
+
+	arrayBuf := make([]byte, arraySize)
+	if _, err := r.ReadAt(arrayBuf, int64(partitionEntryLBA*sectorSize)); err != nil {
+		return nil, fmt.Errorf("reading partition entries: %w", err)
+	}
 
 	partitions := []Partition{}
-	entryBuf := make([]byte, sizeOfPartitionEntry)
 
-	for i := uint32(0); i < numPartitionEntries; i++ {
-		offset := int64(partitionEntryLBA*sectorSize) + int64(i*sizeOfPartitionEntry)
-		if _, err := f.ReadAt(entryBuf, offset); err != nil {
-			return nil, fmt.Errorf("reading partition entry %d: %w", i+1, err)
-		}
+	for i := uint64(0); i < uint64(numPartitionEntries); i++ {
+		entryBuf := arrayBuf[i*uint64(sizeOfPartitionEntry) : (i+1)*uint64(sizeOfPartitionEntry)]
+		number := int(i + 1)
 
 		firstLBA := binary.LittleEndian.Uint64(entryBuf[32:40])
 		lastLBA := binary.LittleEndian.Uint64(entryBuf[40:48])
@@ -60,25 +155,67 @@ func GetGPTPartitions(devicePath string) ([]Partition, error) {
 			continue // Empty partition entry
 		}
 
+		if firstLBA > lastLBA {
+			return nil, partitionError(number, "first LBA %d is after last LBA %d", firstLBA, lastLBA)
+		}
+		if firstLBA < firstUsableLBA || lastLBA > lastUsableLBA {
+			return nil, partitionError(number, "LBA range [%d, %d] is outside the usable range [%d, %d]",
+				firstLBA, lastLBA, firstUsableLBA, lastUsableLBA)
+		}
+
 		nameBytes := entryBuf[56 : 56+72]
 		name := decodeUTF16String(nameBytes)
 
 		partitions = append(partitions, Partition{
-			Number:     int(i + 1),
+			Number:     number,
 			Name:       name,
+			TypeGUID:   formatGUID(entryBuf[0:16]),
+			UUID:       formatGUID(entryBuf[16:32]),
 			FirstLBA:   firstLBA,
 			LastLBA:    lastLBA,
 			NumSectors: lastLBA - firstLBA + 1,
 		})
 	}
 
+	if err := checkOverlaps(partitions); err != nil {
+		return nil, err
+	}
+
+	for i := range partitions {
+		partitions[i].Filesystem = probePartition(r, partitions[i])
+	}
+
 	return partitions, nil
 }
 
+// checkOverlaps makes sure no two partitions share a sector
+func checkOverlaps(partitions []Partition) error {
+	sorted := make([]Partition, len(partitions))
+	copy(sorted, partitions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].FirstLBA < sorted[j].FirstLBA })
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].FirstLBA <= sorted[i-1].LastLBA {
+			return partitionError(sorted[i].Number, "overlaps partition %d", sorted[i-1].Number)
+		}
+	}
+	return nil
+}
+
+func isPowerOfTwo(n uint32) bool {
+	return n != 0 && n&(n-1) == 0
+}
+
+// formatGUID formats an on-disk GUID, whose first three fields are little endian
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
 // Helper to decode UTF-16LE partition names
 func decodeUTF16String(b []byte) string {
 	u16 := make([]uint16, 0, len(b)/2)
-	for i := 0; i < len(b); i += 2 {
+	for i := 0; i+1 < len(b); i += 2 {
 		ch := binary.LittleEndian.Uint16(b[i : i+2])
 		if ch == 0x0000 {
 			break
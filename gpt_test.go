@@ -0,0 +1,118 @@
+package loopback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+type testGPTEntry struct {
+	firstLBA uint64
+	lastLBA  uint64
+	name     string
+}
+
+// buildTestGPT returns a disk image of the given number of sectors with a primary GPT holding the given entries
+func buildTestGPT(sectors uint64, numEntries, entrySize uint32, entries ...testGPTEntry) []byte {
+	img := make([]byte, sectors*sectorSize)
+	hdr := img[sectorSize : 2*sectorSize]
+	copy(hdr, "EFI PART")
+	binary.LittleEndian.PutUint32(hdr[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(hdr[12:16], gptHeaderMinSize)
+	binary.LittleEndian.PutUint64(hdr[24:32], 1)
+	binary.LittleEndian.PutUint64(hdr[32:40], sectors-1)
+	binary.LittleEndian.PutUint64(hdr[40:48], 34)
+	binary.LittleEndian.PutUint64(hdr[48:56], sectors-34)
+	binary.LittleEndian.PutUint64(hdr[72:80], 2)
+	binary.LittleEndian.PutUint32(hdr[80:84], numEntries)
+	binary.LittleEndian.PutUint32(hdr[84:88], entrySize)
+
+	for i, e := range entries {
+		off := 2*sectorSize + uint64(i)*uint64(entrySize)
+		entry := img[off : off+uint64(entrySize)]
+		binary.LittleEndian.PutUint64(entry[32:40], e.firstLBA)
+		binary.LittleEndian.PutUint64(entry[40:48], e.lastLBA)
+		for j, r := range e.name {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], uint16(r))
+		}
+	}
+	return img
+}
+
+func TestReadGPTPartitions(t *testing.T) {
+	img := buildTestGPT(2048, 128, 128,
+		testGPTEntry{firstLBA: 34, lastLBA: 999, name: "boot"},
+		testGPTEntry{},
+		testGPTEntry{firstLBA: 1000, lastLBA: 2014, name: "root"},
+	)
+	// Linux filesystem data type GUID in its on-disk mixed endian form
+	copy(img[2*sectorSize:], []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+	parts, err := ReadGPTPartitions(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("readGPTPartitions() failed: %v", err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 partitions, got %d", len(parts))
+	}
+	if parts[0].Name != "boot" || parts[0].NumSectors != 966 || parts[0].TypeGUID != "0fc63daf-8483-4772-8e79-3d69d8477de4" {
+		t.Fatalf("Unexpected first partition: %+v", parts[0])
+	}
+	if parts[1].Number != 3 || parts[1].Name != "root" {
+		t.Fatalf("Unexpected second partition: %+v", parts[1])
+	}
+}
+
+func TestReadGPTPartitionsRejectsHostileValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		img     []byte
+		wantErr error
+	}{
+		{"huge entry count", buildTestGPT(2048, 0xffffffff, 128), ErrInvalidGPTHeader},
+		{"small entry size", buildTestGPT(2048, 128, 64), ErrInvalidGPTHeader},
+		{"odd entry size", buildTestGPT(2048, 128, 384), ErrInvalidGPTHeader},
+		{"array past end of device", buildTestGPT(40, 128, 128), ErrInvalidGPTHeader},
+		{"inverted partition", buildTestGPT(2048, 128, 128, testGPTEntry{firstLBA: 500, lastLBA: 100}), ErrInvalidPartition},
+		{"partition past usable range", buildTestGPT(2048, 128, 128, testGPTEntry{firstLBA: 100, lastLBA: 4096}), ErrInvalidPartition},
+		{"overlapping partitions", buildTestGPT(2048, 128, 128,
+			testGPTEntry{firstLBA: 100, lastLBA: 500},
+			testGPTEntry{firstLBA: 500, lastLBA: 900},
+		), ErrInvalidPartition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadGPTPartitions(bytes.NewReader(tt.img), int64(len(tt.img)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Expected %v, got %v", tt.wantErr, err)
+			}
+			var gptErr *GPTError
+			if !errors.As(err, &gptErr) {
+				t.Fatalf("Expected a *GPTError, got %T", err)
+			}
+		})
+	}
+}
+
+func FuzzReadGPTPartitions(f *testing.F) {
+	f.Add(buildTestGPT(128, 4, 128, testGPTEntry{firstLBA: 34, lastLBA: 40, name: "seed"}))
+	f.Add(buildTestGPT(128, 2, 256, testGPTEntry{firstLBA: 34, lastLBA: 30}))
+	f.Add(buildTestGPT(128, 1, 128))
+
+	f.Fuzz(func(t *testing.T, img []byte) {
+		parts, err := ReadGPTPartitions(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			return
+		}
+		totalSectors := uint64(len(img)) / sectorSize
+		for _, p := range parts {
+			if p.FirstLBA > p.LastLBA || p.LastLBA >= totalSectors {
+				t.Fatalf("partition %+v escapes a device of %d sectors", p, totalSectors)
+			}
+		}
+		if err := checkOverlaps(parts); err != nil {
+			t.Fatalf("overlapping partitions returned: %v", err)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ImageOptions controls how Open attaches an image
+type ImageOptions struct {
+	// ReadOnly attaches the image read-only
+	ReadOnly bool
+	// ReadOnlyFallback attaches the image read-only when it cannot be opened for writing
+	ReadOnlyFallback bool
+	// NoMappings skips creating the device-mapper mappings for the partitions
+	NoMappings bool
+	// Logger is used for every operation, nothing is logged if nil
+	Logger Logger
+}
+
+// Image is an image file attached to a loop device with its partitions mapped.
+// It owns every resource created by Open and releases them all on Close.
+type Image struct {
+	path       string
+	loopDevice string
+	partitions []Partition
+	mapped     bool
+	log        Logger
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Open attaches the image to a free loop device and maps its GPT partitions.
+// On failure everything set up so far is torn down before returning.
+func Open(path string, opts ImageOptions) (*Image, error) {
+	return OpenContext(context.Background(), path, opts)
+}
+
+// OpenContext is like Open but gives up, rolling back what was set up, once ctx is done
+func OpenContext(ctx context.Context, path string, opts ImageOptions) (*Image, error) {
+	log := opts.Logger
+	if log == nil {
+		log = nopLogger{}
+	}
+
+	loopDevice, err := LoopWithOptions(ctx, path, LoopOptions{ReadOnly: opts.ReadOnly, ReadOnlyFallback: opts.ReadOnlyFallback}, log)
+	if err != nil {
+		return nil, fmt.Errorf("attaching %s: %w", path, err)
+	}
+	img := &Image{path: path, loopDevice: loopDevice, log: log}
+
+	if !opts.NoMappings {
+		img.partitions, err = GetGPTPartitions(loopDevice)
+		if err == nil {
+			img.mapped = true
+			err = CreateMappingsFromDeviceContext(ctx, loopDevice, log)
+		}
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("mapping partitions of %s: %w", path, err), img.Close())
+		}
+	}
+
+	return img, nil
+}
+
+// Path returns the image file backing the loop device
+func (i *Image) Path() string {
+	return i.path
+}
+
+// LoopDevice returns the loop device the image is attached to, like /dev/loop0
+func (i *Image) LoopDevice() string {
+	return i.loopDevice
+}
+
+// Partitions returns the GPT partitions found on the image, empty if it was opened with NoMappings
+func (i *Image) Partitions() []Partition {
+	return i.partitions
+}
+
+// PartitionPath returns the /dev/mapper path for the given partition number
+func (i *Image) PartitionPath(number int) (string, error) {
+	if !i.mapped {
+		return "", fmt.Errorf("partitions of %s are not mapped", i.path)
+	}
+	for _, p := range i.partitions {
+		if p.Number == number {
+			return mappingPath(partitionMappingName(i.loopDevice, p.Number)), nil
+		}
+	}
+	return "", fmt.Errorf("partition %d not found on %s", number, i.path)
+}
+
+// Mount mounts the given partition number on target
+func (i *Image) Mount(number int, target string, opts MountOptions) error {
+	device, err := i.PartitionPath(number)
+	if err != nil {
+		return err
+	}
+	return MountPartition(device, target, opts, i.log)
+}
+
+// Close unmounts everything, removes the mappings and detaches the loop device, in that order.
+// Every step runs even if a previous one failed and all errors are returned. Calling Close again is a no-op.
+func (i *Image) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+
+	var errs []error
+	if err := UnmountAll(i.loopDevice, i.log); err != nil {
+		errs = append(errs, fmt.Errorf("unmounting: %w", err))
+	}
+	if i.mapped {
+		if err := CleanupMappingsForDevice(i.loopDevice, i.log); err != nil {
+			errs = append(errs, fmt.Errorf("removing mappings: %w", err))
+		}
+	}
+	if err := Unloop(i.loopDevice, i.log); err != nil {
+		errs = append(errs, fmt.Errorf("detaching %s: %w", i.loopDevice, err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,72 @@
+package loopback
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// IoctlError is returned when an ioctl fails, it records the device and the request that was issued
+type IoctlError struct {
+	Device  string
+	Request string
+	Err     error
+}
+
+func (e *IoctlError) Error() string {
+	return fmt.Sprintf("ioctl %s on %s: %v", e.Request, e.Device, e.Err)
+}
+
+func (e *IoctlError) Unwrap() error {
+	return e.Err
+}
+
+// ioctlErr wraps a non-nil error returned by the unix.Ioctl* helpers
+func ioctlErr(f *os.File, request string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &IoctlError{Device: f.Name(), Request: request, Err: err}
+}
+
+// loopCtlGetFree asks /dev/loop-control for the number of a free loop device, allocating one if needed
+func loopCtlGetFree(ctl *os.File) (int, error) {
+	n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+	return n, ioctlErr(ctl, "LOOP_CTL_GET_FREE", err)
+}
+
+// loopSetFd attaches the backing file to the loop device
+func loopSetFd(loop, backing *os.File) error {
+	return ioctlErr(loop, "LOOP_SET_FD", unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd())))
+}
+
+// loopClrFd detaches the backing file from the loop device
+func loopClrFd(loop *os.File) error {
+	return ioctlErr(loop, "LOOP_CLR_FD", unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0))
+}
+
+// loopGetStatus returns the current status of the loop device
+func loopGetStatus(loop *os.File) (*unix.LoopInfo64, error) {
+	status, err := unix.IoctlLoopGetStatus64(int(loop.Fd()))
+	return status, ioctlErr(loop, "LOOP_GET_STATUS64", err)
+}
+
+// loopSetStatus updates the status of the loop device
+func loopSetStatus(loop *os.File, status *unix.LoopInfo64) error {
+	return ioctlErr(loop, "LOOP_SET_STATUS64", unix.IoctlLoopSetStatus64(int(loop.Fd()), status))
+}
+
+// loopSetDirectIO switches direct I/O on the backing file on or off
+func loopSetDirectIO(loop *os.File, enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	return ioctlErr(loop, "LOOP_SET_DIRECT_IO", unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_DIRECT_IO, value))
+}
+
+// loopSetBlockSize changes the logical block size of the loop device
+func loopSetBlockSize(loop *os.File, size uint32) error {
+	return ioctlErr(loop, "LOOP_SET_BLOCK_SIZE", unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_BLOCK_SIZE, int(size)))
+}
@@ -0,0 +1,32 @@
+package loopback
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestIoctlErrorOnRegularFile(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "not-a-loop"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer f.Close()
+
+	err = loopClrFd(f)
+	var ioctlError *IoctlError
+	if !errors.As(err, &ioctlError) {
+		t.Fatalf("Expected an *IoctlError, got %T (%v)", err, err)
+	}
+	if ioctlError.Request != "LOOP_CLR_FD" || ioctlError.Device != f.Name() {
+		t.Fatalf("Unexpected request or device in %v", err)
+	}
+	if !errors.Is(err, syscall.ENOTTY) {
+		t.Fatalf("Expected ENOTTY, got %v", err)
+	}
+	if _, err := loopGetStatus(f); err == nil {
+		t.Fatalf("Expected LOOP_GET_STATUS64 to fail on a regular file")
+	}
+}
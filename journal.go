@@ -0,0 +1,271 @@
+package loopback
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	journalKindLoop    = "loop"
+	journalKindMapping = "mapping"
+)
+
+// journalEntry records a single resource created by this package and the process that owns it
+type journalEntry struct {
+	Kind string `json:"kind"`
+	// Device is the loop device path or the mapping name
+	Device string `json:"device"`
+	// Backing is the image file for a loop device or the loop device for a mapping
+	Backing   string `json:"backing"`
+	PID       int    `json:"pid"`
+	StartTime uint64 `json:"start_time"`
+}
+
+var (
+	journalMu   sync.Mutex
+	journalPath string
+)
+
+// SetStateFile enables the on-disk state journal at path, every loop device and mapping created from now on
+// is recorded there until it is released, so Reap can clean up after a crashed process. An empty path disables it.
+func SetStateFile(path string) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	journalPath = path
+}
+
+// Reap releases the resources recorded in the state file whose owner process is gone, checking both the PID and
+// the process start time so a reused PID is not mistaken for the owner. Mounts and mappings are removed before
+// the loop devices below them. It returns the devices that were released.
+func Reap(log Logger) ([]string, error) {
+	var entries []journalEntry
+	err := updateJournal(func(current []journalEntry) []journalEntry {
+		entries = append(entries, current...)
+		return current
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []string
+	var errs []error
+	// Mappings sit on top of the loop devices so they have to go first. A mapping is recorded after the ones it is
+	// stacked on, walking them newest first removes a crypt or verity mapping before the partition below it.
+	for _, kind := range []string{journalKindMapping, journalKindLoop} {
+		for i := len(entries) - 1; i >= 0; i-- {
+			e := entries[i]
+			if e.Kind != kind || processAlive(e.PID, e.StartTime) {
+				continue
+			}
+			log.Printf("Reaping %s %s left by process %d", e.Kind, e.Device, e.PID)
+			if err := reapEntry(e, log); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			journalRemove(e.Kind, e.Device, log)
+			reaped = append(reaped, e.Device)
+		}
+	}
+
+	return reaped, errors.Join(errs...)
+}
+
+func reapEntry(e journalEntry, log Logger) error {
+	switch e.Kind {
+	case journalKindMapping:
+		// Ask the kernel, a node left behind by a failed removal does not mean the mapping is gone
+		if _, err := dmBlockName(e.Device); err != nil {
+			return nil // Already gone
+		}
+		// The name may have been reused by someone else since, only remove it if it still sits on our device
+		if !mappingOnDevice(e.Device, e.Backing) {
+			log.Printf("Mapping %s is no longer on %q, leaving it alone", e.Device, e.Backing)
+			return nil
+		}
+		if err := UnmountAll(mappingPath(e.Device), log); err != nil {
+			log.Printf("Failed to unmount %s: %v", e.Device, err)
+		}
+		// The nodes only go once the mapping has, so a mapping that is still busy can be reaped again later
+		nodes := lookupMappingNodes(e.Device)
+		if err := removeMapping(e.Device, false); err != nil {
+			return fmt.Errorf("reaping mapping %s: %w", e.Device, err)
+		}
+		nodes.remove(log)
+	case journalKindLoop:
+		// The device may have been freed and reused by someone else since, only detach it if it still backs our image
+		backing, err := loopBackingFile(e.Device)
+		if err != nil || backing != e.Backing {
+			return nil
+		}
+		if err := UnmountAll(e.Device, log); err != nil {
+			log.Printf("Failed to unmount %s: %v", e.Device, err)
+		}
+		if err := Unloop(e.Device, log); err != nil {
+			return fmt.Errorf("reaping loop device %s: %w", e.Device, err)
+		}
+	}
+	return nil
+}
+
+// journalAdd records a resource owned by the current process, failures are only logged
+func journalAdd(kind, device, backing string, log Logger) {
+	startTime, _ := processStartTime(os.Getpid())
+	entry := journalEntry{Kind: kind, Device: device, Backing: backing, PID: os.Getpid(), StartTime: startTime}
+	err := updateJournal(func(entries []journalEntry) []journalEntry {
+		return append(entries, entry)
+	})
+	if err != nil {
+		log.Printf("Failed to record %s %s in state file: %v", kind, device, err)
+	}
+}
+
+// journalRemove forgets a resource once it has been released, failures are only logged
+func journalRemove(kind, device string, log Logger) {
+	err := updateJournal(func(entries []journalEntry) []journalEntry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.Kind != kind || e.Device != device {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		log.Printf("Failed to remove %s %s from state file: %v", kind, device, err)
+	}
+}
+
+// updateJournal loads the state file, applies update and writes it back atomically, holding an exclusive lock
+// so several processes can share the same file. It does nothing if no state file is set.
+func updateJournal(update func([]journalEntry) []journalEntry) error {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journalPath == "" {
+		return nil
+	}
+
+	lock, err := os.OpenFile(journalPath+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("locking state file: %w", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	var entries []journalEntry
+	data, err := os.ReadFile(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("parsing state file %s: %w", journalPath, err)
+		}
+	}
+
+	entries = update(entries)
+	if entries == nil {
+		entries = []journalEntry{}
+	}
+
+	data, err = json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := journalPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, journalPath)
+}
+
+// processStartTime returns the start time of a process in clock ticks since boot, from /proc/PID/stat
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name can hold spaces and parens, the fields we want come after the last ')'
+	idx := strings.LastIndexByte(string(data), ')')
+	if idx == -1 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[idx+1:]))
+	// starttime is field 22 overall, the 20th after the command name
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// processAlive reports whether the process that recorded an entry is still running
+func processAlive(pid int, startTime uint64) bool {
+	current, err := processStartTime(pid)
+	if err != nil {
+		return false
+	}
+	return current == startTime
+}
+
+// mappingOnDevice reports whether the mapping called name is stacked directly on backing, a device path or
+// another mapping name, according to /sys/block/dm-N/slaves
+func mappingOnDevice(name, backing string) bool {
+	if backing == "" {
+		return false
+	}
+	dm, err := dmBlockName(name)
+	if err != nil {
+		return false
+	}
+
+	var below string
+	switch {
+	case strings.HasPrefix(backing, "/dev/mapper/"):
+		below, err = dmBlockName(filepath.Base(backing))
+	case !strings.HasPrefix(backing, "/"):
+		below, err = dmBlockName(backing)
+	default:
+		var resolved string
+		resolved, err = filepath.EvalSymlinks(backing)
+		below = filepath.Base(resolved)
+	}
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join("/sys/block", dm, "slaves", below))
+	return err == nil
+}
+
+// dmBlockName returns the kernel name, like dm-3, of the mapping called name
+func dmBlockName(name string) (string, error) {
+	dirs, err := filepath.Glob("/sys/block/dm-*")
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, "dm", "name"))
+		if err == nil && strings.TrimSpace(string(data)) == name {
+			return filepath.Base(dir), nil
+		}
+	}
+	return "", fmt.Errorf("mapping %s not found in /sys/block", name)
+}
+
+// loopBackingFile returns the image currently attached to a loop device
+func loopBackingFile(loopDevice string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(loopDevice), "loop", "backing_file"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00")), nil
+}
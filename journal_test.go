@@ -0,0 +1,90 @@
+package loopback
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJournalAddRemove(t *testing.T) {
+	SetStateFile(filepath.Join(t.TempDir(), "state.json"))
+	defer SetStateFile("")
+
+	journalAdd(journalKindLoop, "/dev/loop42", "/tmp/disk.img", nopLogger{})
+	journalAdd(journalKindMapping, "loop42p1", "/dev/loop42", nopLogger{})
+	journalRemove(journalKindMapping, "loop42p1", nopLogger{})
+
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatalf("Failed to read state file: %v", err)
+	}
+	var entries []journalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Failed to parse state file: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Device != "/dev/loop42" || entries[0].PID != os.Getpid() {
+		t.Fatalf("Unexpected state file entries: %+v", entries)
+	}
+	if !processAlive(entries[0].PID, entries[0].StartTime) {
+		t.Fatalf("Current process should be reported alive")
+	}
+}
+
+func TestReapSkipsLiveOwners(t *testing.T) {
+	SetStateFile(filepath.Join(t.TempDir(), "state.json"))
+	defer SetStateFile("")
+
+	journalAdd(journalKindLoop, "/dev/loop42", "/tmp/disk.img", nopLogger{})
+	// A dead owner whose loop device no longer backs its image is simply forgotten
+	err := updateJournal(func(entries []journalEntry) []journalEntry {
+		return append(entries, journalEntry{Kind: journalKindLoop, Device: "/dev/loop4242", Backing: "/tmp/gone.img", PID: 1 << 30})
+	})
+	if err != nil {
+		t.Fatalf("updateJournal() failed: %v", err)
+	}
+
+	reaped, err := Reap(nopLogger{})
+	if err != nil {
+		t.Fatalf("Reap() failed: %v", err)
+	}
+	if len(reaped) != 1 || reaped[0] != "/dev/loop4242" {
+		t.Fatalf("Expected only /dev/loop4242 to be reaped, got %v", reaped)
+	}
+}
+
+func TestMappingOnDeviceUnknown(t *testing.T) {
+	if mappingOnDevice("loopback-test-missing", "/dev/loop42") {
+		t.Fatalf("A missing mapping cannot sit on a device")
+	}
+	if mappingOnDevice("loopback-test-missing", "") {
+		t.Fatalf("A mapping without a recorded backing device cannot be verified")
+	}
+}
+
+func TestReapMappingsNewestFirst(t *testing.T) {
+	SetStateFile(filepath.Join(t.TempDir(), "state.json"))
+	defer SetStateFile("")
+
+	// A crypt mapping is recorded after the partition it sits on and must be removed before it
+	err := updateJournal(func(entries []journalEntry) []journalEntry {
+		return append(entries,
+			journalEntry{Kind: journalKindLoop, Device: "/dev/loop4242", Backing: "/tmp/gone.img", PID: 1 << 30},
+			journalEntry{Kind: journalKindMapping, Device: "loopback-test-loop4242p2", Backing: "/dev/loop4242", PID: 1 << 30},
+			journalEntry{Kind: journalKindMapping, Device: "loopback-test-crypt", Backing: "loopback-test-loop4242p2", PID: 1 << 30},
+		)
+	})
+	if err != nil {
+		t.Fatalf("updateJournal() failed: %v", err)
+	}
+
+	reaped, err := Reap(nopLogger{})
+	if err != nil {
+		t.Fatalf("Reap() failed: %v", err)
+	}
+	want := []string{"loopback-test-crypt", "loopback-test-loop4242p2", "/dev/loop4242"}
+	if strings.Join(reaped, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected %v to be reaped in that order, got %v", want, reaped)
+	}
+}
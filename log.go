@@ -14,3 +14,16 @@ type Logger interface {
 	Panicf(format string, v ...interface{})
 	Panicln(v ...interface{})
 }
+
+// nopLogger discards everything, used when no Logger is given
+type nopLogger struct{}
+
+func (nopLogger) Print(v ...interface{})                 {}
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Println(v ...interface{})               {}
+func (nopLogger) Fatal(v ...interface{})                 {}
+func (nopLogger) Fatalf(format string, v ...interface{}) {}
+func (nopLogger) Fatalln(v ...interface{})               {}
+func (nopLogger) Panic(v ...interface{})                 {}
+func (nopLogger) Panicf(format string, v ...interface{}) {}
+func (nopLogger) Panicln(v ...interface{})               {}
@@ -1,136 +1,227 @@
 package loopback
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"syscall"
-	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-// syscalls will return an errno type (which implements error) for all calls,
-// including success (errno 0) so we need to check its value to know if its an actual error or not
-func errnoIsErr(err error) error {
-	if err != nil && err.(syscall.Errno) != 0 {
-		return err
-	}
-
-	return nil
-}
-
-// isImageInUse checks if the given image file is already attached to a loop device
-func isImageInUse(imagePath string) (bool, error) {
+// imageLoopDevice returns the loop device the given image file is already attached to, or an empty string
+func imageLoopDevice(imagePath string) (string, error) {
 	// Get absolute path to properly compare with the backing files
 	absImagePath, err := filepath.Abs(imagePath)
 	if err != nil {
-		return false, fmt.Errorf("failed to get absolute path: %w", err)
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
 	// Check /sys/block/loop* directories to find backing files
 	loopDirs, err := filepath.Glob("/sys/block/loop*")
 	if err != nil {
-		return false, fmt.Errorf("failed to list loop devices: %w", err)
+		return "", fmt.Errorf("failed to list loop devices: %w", err)
 	}
 
 	for _, loopDir := range loopDirs {
-		backingFilePath := filepath.Join(loopDir, "loop", "backing_file")
-
-		// Read the backing file path if it exists
-		backingFile, err := os.ReadFile(backingFilePath)
-		if err == nil {
-			// Trim null bytes and newlines
-			backingFileTrimmed := strings.TrimSpace(strings.TrimRight(string(backingFile), "\x00"))
-
-			// Compare with our image path
-			if backingFileTrimmed == absImagePath {
-				return true, nil
-			}
+		// Read the backing file path if it exists and compare with our image path
+		backingFile, err := loopBackingFile(loopDir)
+		if err == nil && backingFile == absImagePath {
+			return filepath.Join("/dev", filepath.Base(loopDir)), nil
 		}
 	}
 
-	return false, nil
+	return "", nil
 }
 
 // Loop will set up a /dev/loopX device linked to the image file by using syscalls directly to set it
-func Loop(img string, rw bool, log Logger) (loopDevice string, err error) {
+func Loop(img string, rw bool, log Logger) (string, error) {
+	return LoopContext(context.Background(), img, rw, log)
+}
+
+// LoopContext is like Loop but aborts once ctx is done, detaching the loop device again if it was already set up
+func LoopContext(ctx context.Context, img string, rw bool, log Logger) (string, error) {
+	return LoopWithOptions(ctx, img, LoopOptions{ReadOnly: !rw}, log)
+}
+
+// LoopOptions controls how LoopWithOptions attaches an image
+type LoopOptions struct {
+	// ReadOnly opens the image read-only and attaches it as a read-only loop device
+	ReadOnly bool
+	// ReadOnlyFallback attaches the image read-only when it cannot be opened for writing, like losetup does
+	ReadOnlyFallback bool
+
+	// Images compressed with xz, gzip or zstd are detected and decompressed to a sparse staging copy, which is
+	// what gets attached. Writes go to the copy, which is freed on Unloop.
+
+	// StagingDir is where compressed images are decompressed, os.TempDir() if empty. The staging file is unlinked
+	// as soon as it is created so nothing is left behind, even if the process crashes.
+	StagingDir string
+	// MemfdLimit stages decompressed images of up to this many bytes in a memfd instead of StagingDir
+	MemfdLimit int64
+	// CacheDir keeps decompressed copies in this directory, named after the SHA-256 of the compressed image, and
+	// reuses them on later attaches. Read-only attaches use the cached copy directly.
+	CacheDir string
+}
+
+// LoopWithOptions is like LoopContext with extra options controlling how the image is attached
+func LoopWithOptions(ctx context.Context, img string, opts LoopOptions, log Logger) (string, error) {
+	loopFile, err := attach(ctx, img, opts, 0, log)
+	if err != nil {
+		return "", err
+	}
+	defer loopFile.Close()
+	return loopFile.Name(), nil
+}
+
+// attach sets up a free loop device for the image with the given extra flags and returns it still open
+func attach(ctx context.Context, img string, opts LoopOptions, flags uint32, log Logger) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Check if image is already in use
-	inUse, err := isImageInUse(img)
+	inUseBy, err := imageLoopDevice(img)
 	if err != nil {
 		log.Printf("Warning: Failed to check if image is in use: %v", err)
-	} else if inUse {
-		return "", fmt.Errorf("image file %s is already in use by another loop device", img)
+	} else if inUseBy != "" {
+		return nil, &ImageInUseError{Image: img, Device: inUseBy}
 	}
 
+	log.Printf("Opening image file %s", img)
+	imageFile, err := openImage(ctx, img, opts, log)
+	if err != nil {
+		log.Printf("failed to open image file")
+		return nil, err
+	}
+	defer imageFile.Close()
+
+	absImg, err := filepath.Abs(img)
+	if err != nil {
+		absImg = img
+	}
+	return attachFile(ctx, imageFile, absImg, flags, log)
+}
+
+// attachFile sets up a free loop device backed by the open image file, name is recorded in the loop status.
+// The device is read-only exactly when imageFile is open read-only.
+func attachFile(ctx context.Context, imageFile *os.File, name string, flags uint32, log Logger) (*os.File, error) {
 	log.Printf("Opening loop control device")
-	fd, err := os.OpenFile("/dev/loop-control", os.O_RDONLY, 0o644)
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDONLY, 0o644)
 	if err != nil {
 		log.Printf("failed to open /dev/loop-control")
-		return loopDevice, err
+		return nil, err
 	}
+	defer ctl.Close()
 
-	defer fd.Close()
 	log.Printf("Getting free loop device")
-	loopInt, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), unix.LOOP_CTL_GET_FREE, 0)
-	if errnoIsErr(err) != nil {
+	loopInt, err := loopCtlGetFree(ctl)
+	if err != nil {
 		log.Printf("failed to get loop device")
-		return loopDevice, err
+		return nil, getFreeError(err)
 	}
 
-	loopDevice = fmt.Sprintf("/dev/loop%d", loopInt)
+	loopDevice := fmt.Sprintf("/dev/loop%d", loopInt)
 	log.Printf("Opening loop device %s", loopDevice)
 	loopFile, err := os.OpenFile(loopDevice, os.O_RDWR, 0)
 	if err != nil {
 		log.Printf("failed to open loop device")
-		return loopDevice, err
+		return nil, err
 	}
-	log.Printf("Opening image file %s", img)
-	imageFile, err := os.OpenFile(img, os.O_RDWR, os.ModePerm)
-	if err != nil {
-		log.Printf("failed to open image file")
-		return loopDevice, err
-	}
-	defer loopFile.Close()
-	defer imageFile.Close()
 
 	log.Printf("Setting loop device")
-	_, _, err = syscall.Syscall(
-		syscall.SYS_IOCTL,
-		loopFile.Fd(),
-		unix.LOOP_SET_FD,
-		imageFile.Fd(),
-	)
-	if errnoIsErr(err) != nil {
+	if err := loopSetFd(loopFile, imageFile); err != nil {
 		log.Printf("failed to set loop device")
-		return loopDevice, err
+		loopFile.Close()
+		return nil, err
 	}
 
-	status := &unix.LoopInfo64{}
-	// Dont set read only flag
-	if !rw {
-		status.Flags &= ^uint32(unix.LO_FLAGS_READ_ONLY)
-	}
+	// LO_FLAGS_READ_ONLY is ignored here, the kernel decided it at LOOP_SET_FD from the access mode of imageFile
+	status := &unix.LoopInfo64{Flags: flags}
+	copy(status.File_name[:unix.LO_NAME_SIZE-1], name)
 
 	log.Printf("Setting loop flags")
-	_, _, err = syscall.Syscall(
-		syscall.SYS_IOCTL,
-		loopFile.Fd(),
-		unix.LOOP_SET_STATUS64,
-		uintptr(unsafe.Pointer(status)),
-	)
-
-	if errnoIsErr(err) != nil {
+	if err := loopSetStatus(loopFile, status); err != nil {
 		log.Printf("failed to set loop device status")
-		return loopDevice, err
+		clearLoop(loopFile, log)
+		loopFile.Close()
+		return nil, err
 	}
 
-	return loopDevice, nil
+	if err := ctx.Err(); err != nil {
+		log.Printf("Context done while setting up %s, detaching it", loopDevice)
+		clearLoop(loopFile, log)
+		loopFile.Close()
+		return nil, err
+	}
+
+	// Reap compares the journal with sysfs, which shows where the backing file really is: a staged copy of a
+	// compressed image, a memfd or a file only known by its fd
+	backing := name
+	if sysfsBacking, err := loopBackingFile(loopDevice); err == nil {
+		backing = sysfsBacking
+	}
+	journalAdd(journalKindLoop, loopDevice, backing, log)
+
+	return loopFile, nil
+}
+
+// openImage opens the image with the access mode matching the requested attachment, which the loop device
+// inherits. Compressed images are decompressed and their staged copy is returned instead.
+func openImage(ctx context.Context, img string, opts LoopOptions, log Logger) (*os.File, error) {
+	format, err := imageCompression(img)
+	if err != nil {
+		return nil, err
+	}
+	if format != "" {
+		return stageCompressedImage(ctx, img, format, opts, log)
+	}
+
+	if opts.ReadOnly {
+		return os.OpenFile(img, os.O_RDONLY, 0)
+	}
+
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err == nil || !opts.ReadOnlyFallback {
+		return f, err
+	}
+	if !errors.Is(err, syscall.EROFS) && !errors.Is(err, os.ErrPermission) {
+		return nil, err
+	}
+
+	log.Printf("Cannot open %s for writing (%v), falling back to read-only", img, err)
+	return os.OpenFile(img, os.O_RDONLY, 0)
+}
+
+// getFreeError maps a LOOP_CTL_GET_FREE failure to ErrNoFreeLoop when the kernel ran out of loop devices, other
+// errors like EPERM or ENODEV from a missing loop driver are not worth retrying and are returned unchanged
+func getFreeError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", ErrNoFreeLoop, err)
+	}
+	return err
+}
+
+// clearLoop detaches a loop device we failed to fully set up
+func clearLoop(loopFile *os.File, log Logger) {
+	if err := loopClrFd(loopFile); err != nil {
+		log.Printf("failed to clear loop device: %v", err)
+	}
 }
 
 // Unloop will clear a loop device and free the underlying image linked to it
 func Unloop(loopDevice string, log Logger) error {
+	return UnloopContext(context.Background(), loopDevice, log)
+}
+
+// UnloopContext is like Unloop but does nothing if ctx is already done
+func UnloopContext(ctx context.Context, loopDevice string, log Logger) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	log.Printf("Clearing loop device %s", loopDevice)
 	fd, err := os.OpenFile(loopDevice, os.O_RDONLY, 0o644)
 	if err != nil {
@@ -139,12 +230,12 @@ func Unloop(loopDevice string, log Logger) error {
 	}
 	defer fd.Close()
 	log.Printf("Clearing loop device")
-	_, _, err = syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), unix.LOOP_CLR_FD, 0)
-
-	if errnoIsErr(err) != nil {
-		log.Printf("failed to set loop device status")
+	if err := loopClrFd(fd); err != nil {
+		log.Printf("failed to clear loop device")
 		return err
 	}
 
+	journalRemove(journalKindLoop, loopDevice, log)
+
 	return nil
 }
@@ -4,15 +4,21 @@
 package loopback_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/itxaka/loopback"
+	"golang.org/x/sys/unix"
 )
 
 // Set this to the path of a real disk image with GPT partitions for testing
@@ -84,16 +90,11 @@ func TestEnd2EndLoopback(t *testing.T) {
 	for _, p := range parts {
 		mapperPath := filepath.Join("/dev/mapper", filepath.Base(loopDev)+"p"+strconv.Itoa(p.Number))
 		stdLogger.Printf("Waiting for mapper device %s to appear", mapperPath)
-		found := false
-		for i := 0; i < 10; i++ {
-			if _, err := os.Stat(mapperPath); err == nil {
-				found = true
-				break
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
-		if !found {
-			stdLogger.Printf("mapper device %s not found", mapperPath)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := loopback.WaitForDevice(ctx, mapperPath)
+		cancel()
+		if err != nil {
+			stdLogger.Printf("mapper device %s not found: %v", mapperPath, err)
 		} else {
 			stdLogger.Printf("mapper device %s found", mapperPath)
 		}
@@ -236,6 +237,17 @@ func TestLoopbackReadOnly(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Loop() failed in read-only mode: %v", err)
 	}
+	status, err := loopback.GetStatus(loopDev)
+	if err != nil {
+		t.Fatalf("GetStatus() failed in read-only mode: %v", err)
+	}
+	if !status.ReadOnly() {
+		t.Fatalf("Expected %s to be read-only", loopDev)
+	}
+	if f, err := os.OpenFile(loopDev, os.O_WRONLY, 0); err == nil {
+		f.Close()
+		t.Fatalf("Expected opening read-only device %s for writing to fail", loopDev)
+	}
 	parts, err := loopback.GetGPTPartitions(loopDev)
 	if err != nil {
 		t.Fatalf("GetGPTPartitions() failed in read-only mode: %v", err)
@@ -301,3 +313,904 @@ func TestLoopbackCleanupPartialFailure(t *testing.T) {
 		stdLogger.Printf("CleanupMappingsForDevice() did not fail for fake device (unexpected)")
 	}
 }
+
+// Test mounting a mapped partition and unmounting everything from the loop device
+func TestLoopbackMountPartition(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/mount.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	loopDev, err := loopback.Loop(imgPath, true, stdLogger)
+	if err != nil {
+		t.Fatalf("Loop() failed: %v", err)
+	}
+	defer loopback.Unloop(loopDev, stdLogger)
+	if err := loopback.CreateMappingsFromDevice(loopDev, stdLogger); err != nil {
+		t.Fatalf("CreateMappingsFromDevice() failed: %v", err)
+	}
+	defer loopback.CleanupMappingsForDevice(loopDev, stdLogger)
+
+	mapping := filepath.Base(loopDev) + "p1"
+	cmd := exec.Command("mkfs.ext4", "-q", "/dev/mapper/"+mapping)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to create filesystem: %v, output: %s", err, string(out))
+	}
+	target := t.TempDir()
+	if err := loopback.MountPartition(mapping, target, loopback.MountOptions{}, stdLogger); err != nil {
+		t.Fatalf("MountPartition() failed: %v", err)
+	}
+	if err := loopback.UnmountAll(loopDev, stdLogger); err != nil {
+		t.Fatalf("UnmountAll() failed: %v", err)
+	}
+}
+
+// Test the Image session sets up and tears down everything
+func TestLoopbackImageSession(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/session.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	img, err := loopback.Open(imgPath, loopback.ImageOptions{Logger: stdLogger})
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if len(img.Partitions()) != 1 {
+		t.Fatalf("Expected 1 partition, got %d", len(img.Partitions()))
+	}
+	partPath, err := img.PartitionPath(1)
+	if err != nil {
+		t.Fatalf("PartitionPath() failed: %v", err)
+	}
+	if _, err := os.Stat(partPath); err != nil {
+		t.Fatalf("Partition device %s not found: %v", partPath, err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Second Close() should be a no-op, got: %v", err)
+	}
+	if _, err := os.Stat(partPath); err == nil {
+		t.Fatalf("Partition device %s still exists after Close()", partPath)
+	}
+}
+
+// Test querying and changing the status of an attached device
+func TestLoopbackStatus(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/status.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	loopDev, err := loopback.Loop(imgPath, true, stdLogger)
+	if err != nil {
+		t.Fatalf("Loop() failed: %v", err)
+	}
+	defer loopback.Unloop(loopDev, stdLogger)
+
+	status, err := loopback.GetStatus(loopDev)
+	if err != nil {
+		t.Fatalf("GetStatus() failed: %v", err)
+	}
+	if status.BackingFile != imgPath || status.Autoclear() {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	// Through a fresh fd autoclear would detach the device right away
+	if err := loopback.SetFlags(loopDev, loopback.FlagAutoclear, 0, stdLogger); err == nil {
+		t.Fatalf("Expected SetFlags() to refuse autoclear")
+	}
+	held, err := os.Open(loopDev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loopback.SetFlagsFile(held, loopback.FlagAutoclear, 0, stdLogger); err != nil {
+		t.Fatalf("SetFlagsFile() failed: %v", err)
+	}
+	if status, err = loopback.GetStatus(loopDev); err != nil || !status.Autoclear() {
+		t.Fatalf("Expected autoclear to be set, got %+v (%v)", status, err)
+	}
+	if err := loopback.SetFlagsFile(held, 0, loopback.FlagAutoclear, stdLogger); err != nil {
+		t.Fatalf("SetFlagsFile() failed: %v", err)
+	}
+	held.Close()
+	if status, err = loopback.GetStatus(loopDev); err != nil || status.BackingFile != imgPath {
+		t.Fatalf("Expected the device to stay attached once autoclear is cleared, got %+v (%v)", status, err)
+	}
+	if err := loopback.SetBlockSize(loopDev, 4096, stdLogger); err != nil {
+		t.Fatalf("SetBlockSize() failed: %v", err)
+	}
+}
+
+// Test the kernel frees an autoclear device once the handle is closed
+func TestLoopbackAutoclear(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/autoclear.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	handle, err := loopback.LoopAutoclear(context.Background(), imgPath, loopback.LoopOptions{}, stdLogger)
+	if err != nil {
+		t.Fatalf("LoopAutoclear() failed: %v", err)
+	}
+	status, err := loopback.GetStatus(handle.Path())
+	if err != nil || !status.Autoclear() {
+		t.Fatalf("Expected autoclear to be set, got %+v (%v)", status, err)
+	}
+	if err := handle.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err := loopback.GetStatus(handle.Path()); err == nil {
+		t.Fatalf("Expected %s to be freed after Close()", handle.Path())
+	}
+}
+
+// Test busy mappings are reported with their holders and can be removed deferred
+func TestLoopbackCleanupBusyMapping(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/busy.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	loopDev, err := loopback.Loop(imgPath, true, stdLogger)
+	if err != nil {
+		t.Fatalf("Loop() failed: %v", err)
+	}
+	defer loopback.Unloop(loopDev, stdLogger)
+	if err := loopback.CreateMappingsFromDevice(loopDev, stdLogger); err != nil {
+		t.Fatalf("CreateMappingsFromDevice() failed: %v", err)
+	}
+	defer loopback.CleanupMappingsForDevice(loopDev, stdLogger)
+
+	holder, err := os.Open("/dev/mapper/" + filepath.Base(loopDev) + "p1")
+	if err != nil {
+		t.Fatalf("Failed to open mapping: %v", err)
+	}
+	defer holder.Close()
+
+	opts := loopback.CleanupOptions{Retries: 2, Backoff: 10 * time.Millisecond}
+	report, err := loopback.CleanupMappingsForDeviceWithOptions(context.Background(), loopDev, opts, stdLogger)
+	if err == nil || len(report.Busy) != 1 {
+		t.Fatalf("Expected the mapping to be reported busy, got %+v (%v)", report, err)
+	}
+	found := false
+	for _, p := range report.Busy[0].Processes {
+		found = found || p.PID == os.Getpid()
+	}
+	if !found {
+		t.Fatalf("Expected this process to be listed as a holder, got %+v", report.Busy[0].Processes)
+	}
+
+	opts.DeferredRemove = true
+	report, err = loopback.CleanupMappingsForDeviceWithOptions(context.Background(), loopDev, opts, stdLogger)
+	if err != nil || len(report.Deferred) != 1 {
+		t.Fatalf("Expected the mapping removal to be deferred, got %+v (%v)", report, err)
+	}
+}
+
+// Test unloop refuses a busy device and can tear down its holders
+func TestLoopbackUnloopBusy(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/unloop_busy.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	loopDev, err := loopback.Loop(imgPath, true, stdLogger)
+	if err != nil {
+		t.Fatalf("Loop() failed: %v", err)
+	}
+	if err := loopback.CreateMappingsFromDevice(loopDev, stdLogger); err != nil {
+		t.Fatalf("CreateMappingsFromDevice() failed: %v", err)
+	}
+
+	err = loopback.UnloopWithOptions(context.Background(), loopDev, loopback.UnloopOptions{Check: true}, stdLogger)
+	var busy *loopback.DeviceBusyError
+	if !errors.As(err, &busy) || len(busy.Usage.Holders) != 1 {
+		t.Fatalf("Expected a DeviceBusyError listing the mapping, got %v", err)
+	}
+
+	err = loopback.UnloopWithOptions(context.Background(), loopDev, loopback.UnloopOptions{Cascade: true}, stdLogger)
+	if err != nil {
+		t.Fatalf("Cascading UnloopWithOptions() failed: %v", err)
+	}
+}
+
+// Test unlocking a LUKS2 partition and tearing the crypt mapping down with the partition mappings
+func TestLoopbackLUKS(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if _, err := exec.LookPath("cryptsetup"); err != nil {
+		t.Skip("cryptsetup is needed to format the test partition")
+	}
+	imgPath := "/tmp/luks.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	loopDev, err := loopback.Loop(imgPath, true, stdLogger)
+	if err != nil {
+		t.Fatalf("Loop() failed: %v", err)
+	}
+	defer loopback.Unloop(loopDev, stdLogger)
+	if err := loopback.CreateMappingsFromDevice(loopDev, stdLogger); err != nil {
+		t.Fatalf("CreateMappingsFromDevice() failed: %v", err)
+	}
+	defer loopback.CleanupMappingsForDevice(loopDev, stdLogger)
+
+	partition := "/dev/mapper/" + filepath.Base(loopDev) + "p1"
+	cmd := exec.Command("cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--pbkdf", "pbkdf2",
+		"--pbkdf-force-iterations", "1000", partition, "-")
+	cmd.Stdin = strings.NewReader("secret")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("cryptsetup luksFormat failed: %v: %s", err, out)
+	}
+
+	if _, err := loopback.OpenLUKS(context.Background(), partition, "luks-test", loopback.LUKSOptions{Passphrase: []byte("wrong")}, stdLogger); !errors.Is(err, loopback.ErrWrongPassphrase) {
+		t.Fatalf("Expected ErrWrongPassphrase, got %v", err)
+	}
+	dev, err := loopback.OpenLUKS(context.Background(), partition, "luks-test", loopback.LUKSOptions{Passphrase: []byte("secret")}, stdLogger)
+	if err != nil {
+		t.Fatalf("OpenLUKS() failed: %v", err)
+	}
+	if _, err := os.Stat(dev); err != nil {
+		t.Fatalf("Crypt device %s not found: %v", dev, err)
+	}
+
+	if err := loopback.CleanupMappingsForDevice(loopDev, stdLogger); err != nil {
+		t.Fatalf("CleanupMappingsForDevice() failed: %v", err)
+	}
+	if _, err := os.Stat(dev); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed along with the partition mappings", dev)
+	}
+}
+
+// Test computing a verity hash tree into the hash partition and activating the data partition through it
+func TestLoopbackVerity(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/verity.img"
+	defer os.Remove(imgPath)
+	cmd := exec.Command("dd", "if=/dev/urandom", "of="+imgPath, "bs=1M", "count=50")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	cmd = exec.Command("sgdisk", "-o", "-n", "1:2048:+40M", "-n", "2:0:+2M", "-t", "2:2c7357ed-ebd2-46d9-aec1-23d437ec2bf5", imgPath)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to partition image: %v", err)
+	}
+
+	img, err := loopback.Open(imgPath, loopback.ImageOptions{Logger: stdLogger})
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer img.Close()
+
+	dataPath, _ := img.PartitionPath(1)
+	hashPath, _ := img.PartitionPath(2)
+	data, err := os.Open(dataPath)
+	if err != nil {
+		t.Fatalf("Failed to open data partition: %v", err)
+	}
+	defer data.Close()
+	hash, err := os.OpenFile(hashPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open hash partition: %v", err)
+	}
+	rootHash, err := loopback.VerityHashTree(data, 40<<20, hash, loopback.VerityOptions{})
+	hash.Close()
+	if err != nil {
+		t.Fatalf("VerityHashTree() failed: %v", err)
+	}
+
+	dev, err := img.OpenVerity(context.Background(), 1, "verity-test", rootHash, loopback.VerityOptions{})
+	if err != nil {
+		t.Fatalf("OpenVerity() failed: %v", err)
+	}
+	verified, err := os.ReadFile(dev)
+	if err != nil {
+		t.Fatalf("Reading through verity failed: %v", err)
+	}
+	if len(verified) != 40<<20 {
+		t.Fatalf("Expected 40MiB of verified data, got %d bytes", len(verified))
+	}
+}
+
+// Test writes to a snapshot land in the COW file until they are merged into the base image
+func TestLoopbackSnapshot(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/snapshot_base.img"
+	cowPath := "/tmp/snapshot.cow"
+	defer os.Remove(imgPath)
+	defer os.Remove(cowPath)
+	if err := os.WriteFile(imgPath, make([]byte, 16<<20), 0o644); err != nil {
+		t.Fatalf("Failed to create base image: %v", err)
+	}
+
+	snap, err := loopback.CreateSnapshot(context.Background(), imgPath, cowPath, "snapshot-test", loopback.SnapshotOptions{COWSize: 8 << 20, Mergeable: true}, stdLogger)
+	if err != nil {
+		t.Fatalf("CreateSnapshot() failed: %v", err)
+	}
+	defer snap.Discard()
+
+	f, err := os.OpenFile(snap.Path(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open snapshot: %v", err)
+	}
+	_, err = f.WriteAt([]byte("changed"), 4096)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to write to snapshot: %v", err)
+	}
+
+	readBase := func() string {
+		base, err := os.ReadFile(imgPath)
+		if err != nil {
+			t.Fatalf("Failed to read base image: %v", err)
+		}
+		return string(base[4096 : 4096+7])
+	}
+	if got := readBase(); got == "changed" {
+		t.Fatalf("Write to the snapshot reached the base image")
+	}
+
+	if err := snap.Merge(context.Background()); err != nil {
+		t.Fatalf("Merge() failed: %v", err)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if got := readBase(); got != "changed" {
+		t.Fatalf("Expected the merged change in the base image, got %q", got)
+	}
+}
+
+// Test cloning an image into a thin pool and partition-mapping the clone
+func TestLoopbackThinPool(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/thin_base.img"
+	dataPath := "/tmp/thin_data.img"
+	metaPath := "/tmp/thin_meta.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	defer os.Remove(dataPath)
+	defer os.Remove(metaPath)
+
+	pool, err := loopback.CreateThinPool(context.Background(), "thin-test", dataPath, metaPath, loopback.ThinPoolOptions{DataSize: 64 << 20}, stdLogger)
+	if err != nil {
+		t.Fatalf("CreateThinPool() failed: %v", err)
+	}
+	defer pool.Close()
+
+	clone, err := pool.CreateClone(context.Background(), 1, "thin-clone", imgPath)
+	if err != nil {
+		t.Fatalf("CreateClone() failed: %v", err)
+	}
+	if err := loopback.CreateMappingsFromDevice(clone, stdLogger); err != nil {
+		t.Fatalf("CreateMappingsFromDevice() on the clone failed: %v", err)
+	}
+	if _, err := os.Stat("/dev/mapper/thin-clonep1"); err != nil {
+		t.Fatalf("Expected a partition mapping for the clone: %v", err)
+	}
+
+	snap, err := pool.CreateSnapshot(context.Background(), 2, "thin-snap", "thin-clone")
+	if err != nil {
+		t.Fatalf("CreateSnapshot() failed: %v", err)
+	}
+	if _, err := os.Stat(snap); err != nil {
+		t.Fatalf("Snapshot %s not found: %v", snap, err)
+	}
+
+	if err := pool.DeleteVolume("thin-clone"); err != nil {
+		t.Fatalf("DeleteVolume() failed: %v", err)
+	}
+	if _, err := os.Stat("/dev/mapper/thin-clonep1"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the clone partition mapping to be removed with the clone")
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+}
+
+// Test a disk image split in two files is assembled into one partitionable device
+func TestLoopbackConcat(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/concat.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	whole, err := os.ReadFile(imgPath)
+	if err != nil {
+		t.Fatalf("Failed to read image: %v", err)
+	}
+	half := len(whole) / 2
+	parts := []string{"/tmp/concat.part1", "/tmp/concat.part2"}
+	for i, chunk := range [][]byte{whole[:half], whole[half:]} {
+		if err := os.WriteFile(parts[i], chunk, 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", parts[i], err)
+		}
+		defer os.Remove(parts[i])
+	}
+
+	dev, err := loopback.Concat(context.Background(), "concat-test", parts, loopback.LoopOptions{}, stdLogger)
+	if err != nil {
+		t.Fatalf("Concat() failed: %v", err)
+	}
+	defer dev.Close()
+
+	partitions, err := loopback.GetGPTPartitions(dev.Path())
+	if err != nil || len(partitions) != 1 {
+		t.Fatalf("Expected the GPT of the whole image, got %v (%v)", partitions, err)
+	}
+	if err := loopback.CreateMappingsFromDevice(dev.Path(), stdLogger); err != nil {
+		t.Fatalf("CreateMappingsFromDevice() failed: %v", err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err := os.Stat("/dev/mapper/concat-testp1"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the partition mapping to be removed with the device")
+	}
+}
+
+// Test creating, inspecting, reloading and removing a device with the generic table API
+func TestLoopbackDeviceMapperAPI(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	name := "dmapi-test"
+	if err := loopback.CreateDevice(name, "", []loopback.Target{{Length: 2048, Type: "zero"}}, stdLogger); err != nil {
+		t.Fatalf("CreateDevice() failed: %v", err)
+	}
+	defer loopback.Remove(name, stdLogger)
+
+	devices, err := loopback.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	found := false
+	for _, d := range devices {
+		found = found || d.Name == name
+	}
+	if !found {
+		t.Fatalf("Expected %s in %+v", name, devices)
+	}
+
+	table := []loopback.Target{{Length: 1024, Type: "zero"}, {Start: 1024, Length: 1024, Type: "error"}}
+	if err := loopback.ReloadTable(name, table); err != nil {
+		t.Fatalf("ReloadTable() failed: %v", err)
+	}
+	if err := loopback.Suspend(name); err != nil {
+		t.Fatalf("Suspend() failed: %v", err)
+	}
+	if err := loopback.Resume(name); err != nil {
+		t.Fatalf("Resume() failed: %v", err)
+	}
+
+	live, err := loopback.Table(name)
+	if err != nil || len(live) != 2 || live[1].Type != "error" {
+		t.Fatalf("Expected the reloaded table, got %+v (%v)", live, err)
+	}
+	if _, err := loopback.Status(name); err != nil {
+		t.Fatalf("Status() failed: %v", err)
+	}
+
+	if err := loopback.Remove(name, stdLogger); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+}
+
+// Test switching faults on and off on a wrapped image
+func TestLoopbackFaultyDisk(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	imgPath := "/tmp/faulty.img"
+	if err := os.WriteFile(imgPath, make([]byte, 8<<20), 0o644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	defer os.Remove(imgPath)
+
+	disk, err := loopback.NewFaultyImage(context.Background(), imgPath, "faulty-test", loopback.LoopOptions{}, stdLogger)
+	if err != nil {
+		t.Fatalf("NewFaultyImage() failed: %v", err)
+	}
+	defer disk.Close()
+
+	read := func(sector int64) error {
+		f, err := os.OpenFile(disk.Path(), os.O_RDONLY|syscall.O_DIRECT, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// O_DIRECT needs an aligned buffer, which an anonymous mapping is
+		buf, err := syscall.Mmap(-1, 0, 4096, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+		if err != nil {
+			return err
+		}
+		defer syscall.Munmap(buf)
+		_, err = f.ReadAt(buf[:512], sector*512)
+		return err
+	}
+
+	if err := read(100); err != nil {
+		t.Fatalf("Read from the healthy disk failed: %v", err)
+	}
+	if err := disk.FailRanges([]loopback.SectorRange{{Start: 96, Length: 16}}); err != nil {
+		t.Fatalf("FailRanges() failed: %v", err)
+	}
+	if err := read(100); err == nil {
+		t.Fatalf("Expected the read in the failing range to fail")
+	}
+	if err := read(200); err != nil {
+		t.Fatalf("Read outside the failing range failed: %v", err)
+	}
+	if err := disk.Delay(10*time.Millisecond, 10*time.Millisecond); err != nil {
+		t.Fatalf("Delay() failed: %v", err)
+	}
+	if err := disk.Healthy(); err != nil {
+		t.Fatalf("Healthy() failed: %v", err)
+	}
+	if err := read(100); err != nil {
+		t.Fatalf("Read after switching back to healthy failed: %v", err)
+	}
+}
+
+// Test reading the partitions of a qcow2 image and converting it back to raw
+func TestLoopbackQcow2(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img is needed to create the qcow2 image")
+	}
+	imgPath := "/tmp/qcow2_source.img"
+	qcowPath := "/tmp/qcow2_test.qcow2"
+	rawPath := "/tmp/qcow2_converted.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	defer os.Remove(qcowPath)
+	defer os.Remove(rawPath)
+	if out, err := exec.Command("qemu-img", "convert", "-c", "-O", "qcow2", imgPath, qcowPath).CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img convert failed: %v: %s", err, out)
+	}
+
+	q, err := loopback.OpenQcow2(qcowPath)
+	if err != nil {
+		t.Fatalf("OpenQcow2() failed: %v", err)
+	}
+	defer q.Close()
+	partitions, err := loopback.ReadGPTPartitions(q, q.Size())
+	if err != nil || len(partitions) != 1 {
+		t.Fatalf("Expected 1 partition in the qcow2 image, got %v (%v)", partitions, err)
+	}
+	if err := q.ConvertToRaw(rawPath); err != nil {
+		t.Fatalf("ConvertToRaw() failed: %v", err)
+	}
+	if out, err := exec.Command("cmp", imgPath, rawPath).CombinedOutput(); err != nil {
+		t.Fatalf("Converted image differs from the source: %s", out)
+	}
+}
+
+func TestLoopbackDiskImageFormats(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img is needed to create the VHD, VHDX and VMDK images")
+	}
+	imgPath := "/tmp/disk_formats_source.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+
+	for _, format := range []string{"vpc", "vhdx", "vmdk"} {
+		t.Run(format, func(t *testing.T) {
+			imagePath := "/tmp/disk_formats_test." + format
+			rawPath := "/tmp/disk_formats_converted.img"
+			defer os.Remove(imagePath)
+			defer os.Remove(rawPath)
+			// force_size keeps the VHD virtual size from being rounded to a CHS geometry
+			args := []string{"convert", "-O", format, imgPath, imagePath}
+			if format == "vpc" {
+				args = []string{"convert", "-O", format, "-o", "force_size=on", imgPath, imagePath}
+			}
+			if out, err := exec.Command("qemu-img", args...).CombinedOutput(); err != nil {
+				t.Fatalf("qemu-img convert failed: %v: %s", err, out)
+			}
+
+			d, err := loopback.OpenDisk(imagePath)
+			if err != nil {
+				t.Fatalf("OpenDisk() failed: %v", err)
+			}
+			defer d.Close()
+			partitions, err := loopback.ReadGPTPartitions(d, d.Size())
+			if err != nil || len(partitions) != 1 {
+				t.Fatalf("Expected 1 partition in the %s image, got %v (%v)", format, partitions, err)
+			}
+			if err := loopback.ConvertToRaw(d, rawPath); err != nil {
+				t.Fatalf("ConvertToRaw() failed: %v", err)
+			}
+			if out, err := exec.Command("cmp", imgPath, rawPath).CombinedOutput(); err != nil {
+				t.Fatalf("Converted image differs from the source: %s", out)
+			}
+		})
+	}
+}
+
+func TestLoopbackCompressedImage(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz is needed to compress the image")
+	}
+	imgPath := "/tmp/compressed_test.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	defer os.Remove(imgPath + ".xz")
+	if out, err := exec.Command("xz", "-kf", imgPath).CombinedOutput(); err != nil {
+		t.Fatalf("xz failed: %v: %s", err, out)
+	}
+
+	cacheDir := t.TempDir()
+	for _, opts := range []loopback.LoopOptions{{}, {MemfdLimit: 200 << 20}, {ReadOnly: true}, {ReadOnly: true, MemfdLimit: 200 << 20}, {ReadOnly: true, CacheDir: cacheDir}} {
+		loopDev, err := loopback.LoopWithOptions(context.Background(), imgPath+".xz", opts, stdLogger)
+		if err != nil {
+			t.Fatalf("LoopWithOptions(%+v) failed: %v", opts, err)
+		}
+		status, err := loopback.GetStatus(loopDev)
+		if err != nil {
+			t.Fatalf("GetStatus() failed: %v", err)
+		}
+		stdLogger.Printf("Compressed image attached to %s, backed by %s", loopDev, status.BackingFile)
+		wantRO := "0"
+		if opts.ReadOnly {
+			wantRO = "1"
+		}
+		ro, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(loopDev), "ro"))
+		if err != nil || strings.TrimSpace(string(ro)) != wantRO {
+			t.Fatalf("Expected %s read-only to be %t, sysfs says %q (%v)", loopDev, opts.ReadOnly, ro, err)
+		}
+		if out, err := exec.Command("cmp", imgPath, loopDev).CombinedOutput(); err != nil {
+			t.Fatalf("Loop device content differs from the decompressed image: %s", out)
+		}
+		if err := loopback.Unloop(loopDev, stdLogger); err != nil {
+			t.Fatalf("Unloop() failed: %v", err)
+		}
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 1 {
+		t.Fatalf("Expected the decompressed copy in the cache, got %v", entries)
+	}
+}
+
+func TestLoopbackMemfd(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	imgPath := "/tmp/memfd_test.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	data, err := os.ReadFile(imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loopDev, err := loopback.LoopBytes(context.Background(), data, loopback.LoopOptions{}, stdLogger)
+	if err != nil {
+		t.Fatalf("LoopBytes() failed: %v", err)
+	}
+	parts, err := loopback.GetGPTPartitions(loopDev)
+	if err != nil || len(parts) != 1 {
+		t.Fatalf("Expected 1 partition on the memfd loop device, got %v (%v)", parts, err)
+	}
+	if err := loopback.Unloop(loopDev, stdLogger); err != nil {
+		t.Fatalf("Unloop() failed: %v", err)
+	}
+
+	loopDev, err = loopback.LoopMemfd(context.Background(), 8<<20, loopback.LoopOptions{}, stdLogger)
+	if err != nil {
+		t.Fatalf("LoopMemfd() failed: %v", err)
+	}
+	if out, err := exec.Command("blockdev", "--getsize64", loopDev).Output(); err != nil || strings.TrimSpace(string(out)) != "8388608" {
+		t.Fatalf("Unexpected size of the memfd loop device: %s (%v)", out, err)
+	}
+	if err := loopback.Unloop(loopDev, stdLogger); err != nil {
+		t.Fatalf("Unloop() failed: %v", err)
+	}
+
+	// An open file is recognized as attached already even without its path
+	f, err := os.Open(imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	loopDev, err = loopback.LoopFile(context.Background(), f, loopback.LoopOptions{}, stdLogger)
+	if err != nil {
+		t.Fatalf("LoopFile() failed: %v", err)
+	}
+	defer loopback.Unloop(loopDev, stdLogger)
+	status, err := loopback.GetStatus(loopDev)
+	if err != nil || !status.ReadOnly() {
+		t.Fatalf("Expected a read-only device for a read-only file, got %+v (%v)", status, err)
+	}
+	if _, err := loopback.LoopFile(context.Background(), f, loopback.LoopOptions{}, stdLogger); !errors.Is(err, loopback.ErrImageInUse) {
+		t.Fatalf("Expected ErrImageInUse attaching the same file twice, got %v", err)
+	}
+}
+
+// Test that ReadOnly makes fd-backed loop devices read-only even when the fd is writable
+func TestLoopbackMemfdReadOnly(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	opts := loopback.LoopOptions{ReadOnly: true}
+	f, err := os.CreateTemp("", "loopfile-ro-*.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Truncate(8 << 20)
+
+	attach := map[string]func() (string, error){
+		"LoopFile":  func() (string, error) { return loopback.LoopFile(context.Background(), f, opts, stdLogger) },
+		"LoopMemfd": func() (string, error) { return loopback.LoopMemfd(context.Background(), 8<<20, opts, stdLogger) },
+		"LoopBytes": func() (string, error) {
+			return loopback.LoopBytes(context.Background(), make([]byte, 8<<20), opts, stdLogger)
+		},
+	}
+	for name, loop := range attach {
+		loopDev, err := loop()
+		if err != nil {
+			t.Fatalf("%s() failed: %v", name, err)
+		}
+		ro, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(loopDev), "ro"))
+		loopback.Unloop(loopDev, stdLogger)
+		if err != nil || strings.TrimSpace(string(ro)) != "1" {
+			t.Fatalf("Expected %s to attach %s read-only, sysfs says %q (%v)", name, loopDev, ro, err)
+		}
+	}
+	// The caller's file keeps its access mode
+	if _, err := f.WriteAt([]byte("still writable"), 0); err != nil {
+		t.Fatalf("Writing to the file after LoopFile() failed: %v", err)
+	}
+}
+
+func TestLoopbackReapChecksMappingOwner(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	imgPath := "/tmp/reap_owner_test.img"
+	createTestDiskImage(t, imgPath)
+	defer os.Remove(imgPath)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	loopback.SetStateFile(statePath)
+	defer loopback.SetStateFile("")
+
+	loopDev, err := loopback.Loop(imgPath, true, stdLogger)
+	if err != nil {
+		t.Fatalf("Loop() failed: %v", err)
+	}
+	defer loopback.Unloop(loopDev, stdLogger)
+	if err := loopback.CreateMappingsFromDevice(loopDev, stdLogger); err != nil {
+		t.Fatalf("CreateMappingsFromDevice() failed: %v", err)
+	}
+	defer loopback.CleanupMappingsForDevice(loopDev, stdLogger)
+	mapping := filepath.Base(loopDev) + "p1"
+
+	// Pretend a dead process created a mapping of the same name on another device
+	dead := fmt.Sprintf(`[{"kind": "mapping", "device": %q, "backing": "/dev/loop4242", "pid": %d, "start_time": 0}]`, mapping, 1<<30)
+	if err := os.WriteFile(statePath, []byte(dead), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loopback.Reap(stdLogger); err != nil {
+		t.Fatalf("Reap() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("/dev/mapper", mapping)); err != nil {
+		t.Fatalf("Reap() removed %s, which is not on the recorded device: %v", mapping, err)
+	}
+}
+
+// Test that removing a mapping leaves the device nodes of other mappings alone, whatever its name
+func TestLoopbackRemoveKeepsOtherNodes(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	decoy := "nodes-decoy"
+	if err := loopback.CreateDevice(decoy, "", []loopback.Target{{Length: 2048, Type: "zero"}}, stdLogger); err != nil {
+		t.Fatalf("CreateDevice() failed: %v", err)
+	}
+	defer loopback.Remove(decoy, stdLogger)
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join("/dev/mapper", decoy), &st); err != nil {
+		t.Fatal(err)
+	}
+	minor := unix.Minor(uint64(st.Rdev))
+	decoyNode := fmt.Sprintf("/dev/dm-%d", minor)
+	if _, err := os.Stat(decoyNode); err != nil {
+		t.Skipf("no %s node to check: %v", decoyNode, err)
+	}
+
+	// The name ends like a partition mapping numbered after the decoy device
+	name := fmt.Sprintf("nodes-testp%d", minor)
+	if err := loopback.CreateDevice(name, "", []loopback.Target{{Length: 2048, Type: "zero"}}, stdLogger); err != nil {
+		t.Fatalf("CreateDevice() failed: %v", err)
+	}
+	if err := loopback.Remove(name, stdLogger); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if _, err := os.Stat(decoyNode); err != nil {
+		t.Fatalf("Remove(%s) removed %s of another mapping: %v", name, decoyNode, err)
+	}
+}
+
+// Test that a thin pool whose name is taken leaves the existing mapping alone
+func TestLoopbackThinPoolNameTaken(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	dataPath := "/tmp/thin_taken_data.img"
+	metaPath := "/tmp/thin_taken_meta.img"
+	defer os.Remove(dataPath)
+	defer os.Remove(metaPath)
+	name := "thin-taken-test"
+	if err := loopback.CreateDevice(name, "", []loopback.Target{{Length: 2048, Type: "zero"}}, stdLogger); err != nil {
+		t.Fatalf("CreateDevice() failed: %v", err)
+	}
+	defer loopback.Remove(name, stdLogger)
+
+	if _, err := loopback.CreateThinPool(context.Background(), name, dataPath, metaPath, loopback.ThinPoolOptions{DataSize: 64 << 20}, stdLogger); err == nil {
+		t.Fatalf("Expected CreateThinPool() to fail on a taken name")
+	}
+	if _, err := os.Stat(filepath.Join("/dev/mapper", name)); err != nil {
+		t.Fatalf("Failed CreateThinPool() removed the existing %s: %v", name, err)
+	}
+	if _, err := os.Stat(dataPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the data file created by the failed call to be removed")
+	}
+}
+
+// Test that concatenating into a taken name leaves the existing mapping alone
+func TestLoopbackConcatNameTaken(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	part := "/tmp/concat_taken.part"
+	if err := os.WriteFile(part, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(part)
+	name := "concat-taken-test"
+	if err := loopback.CreateDevice(name, "", []loopback.Target{{Length: 2048, Type: "zero"}}, stdLogger); err != nil {
+		t.Fatalf("CreateDevice() failed: %v", err)
+	}
+	defer loopback.Remove(name, stdLogger)
+
+	if _, err := loopback.Concat(context.Background(), name, []string{part}, loopback.LoopOptions{}, stdLogger); err == nil {
+		t.Fatalf("Expected Concat() to fail on a taken name")
+	}
+	if _, err := os.Stat(filepath.Join("/dev/mapper", name)); err != nil {
+		t.Fatalf("Failed Concat() removed the existing %s: %v", name, err)
+	}
+}
+
+// Test that a snapshot whose names are taken leaves the existing mappings alone
+func TestLoopbackSnapshotNameTaken(t *testing.T) {
+	stdLogger := log.New(os.Stdout, "[loopback test] ", log.LstdFlags)
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	imgPath := "/tmp/snapshot_taken_base.img"
+	cowPath := "/tmp/snapshot_taken.cow"
+	defer os.Remove(imgPath)
+	defer os.Remove(cowPath)
+	if err := os.WriteFile(imgPath, make([]byte, 16<<20), 0o644); err != nil {
+		t.Fatalf("Failed to create base image: %v", err)
+	}
+
+	// Either mapping being taken makes CreateSnapshot fail, the other one it created is rolled back
+	for _, taken := range []string{"snapshot-taken-test", "snapshot-taken-test-origin"} {
+		if err := loopback.CreateDevice(taken, "", []loopback.Target{{Length: 2048, Type: "zero"}}, stdLogger); err != nil {
+			t.Fatalf("CreateDevice() failed: %v", err)
+		}
+		_, err := loopback.CreateSnapshot(context.Background(), imgPath, cowPath, "snapshot-taken-test", loopback.SnapshotOptions{COWSize: 8 << 20}, stdLogger)
+		if err == nil {
+			t.Fatalf("Expected CreateSnapshot() to fail with %s taken", taken)
+		}
+		if _, err := os.Stat(filepath.Join("/dev/mapper", taken)); err != nil {
+			t.Fatalf("Failed CreateSnapshot() removed the existing %s: %v", taken, err)
+		}
+		if err := loopback.Remove(taken, stdLogger); err != nil {
+			t.Fatalf("Remove() failed: %v", err)
+		}
+	}
+}
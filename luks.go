@@ -0,0 +1,531 @@
+package loopback
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	luks2BinaryHeaderSize = 4096
+	luks2ChecksumOffset   = 448
+	luks2ChecksumLength   = 64
+
+	// Keyslot limits, the header comes from the device and must not be able to make Unlock allocate or compute
+	// without bound. The area and argon2 limits are the ones cryptsetup enforces for LUKS2, the time and
+	// iteration limits are far above what cryptsetup benchmarks to.
+	luks2MaxKeyslotsSize  = 128 << 20
+	luks2MaxKeySize       = 512
+	luks2MaxPBKDF2Iters   = 1 << 28
+	luks2MinArgon2Memory  = 32
+	luks2MaxArgon2Memory  = 4 << 20
+	luks2MaxArgon2Threads = 4
+	luks2MaxArgon2Time    = 1 << 16
+)
+
+var (
+	// ErrNotLUKS2 is returned when a device does not start with a LUKS2 header
+	ErrNotLUKS2 = errors.New("not a LUKS2 device")
+	// ErrWrongPassphrase is returned when no keyslot can be unlocked with the given passphrase or key file
+	ErrWrongPassphrase = errors.New("no keyslot matches the passphrase")
+)
+
+// LUKS2Header is the parsed header of a LUKS2 device
+type LUKS2Header struct {
+	UUID       string
+	Label      string
+	HeaderSize uint64
+	metadata   luks2Metadata
+}
+
+type luks2Metadata struct {
+	Keyslots map[string]luks2Keyslot `json:"keyslots"`
+	Segments map[string]luks2Segment `json:"segments"`
+	Digests  map[string]luks2Digest  `json:"digests"`
+}
+
+type luks2Keyslot struct {
+	Type     string  `json:"type"`
+	KeySize  int     `json:"key_size"`
+	Priority *int    `json:"priority,omitempty"`
+	AF       luks2AF `json:"af"`
+	Area     struct {
+		Type       string `json:"type"`
+		Offset     uint64 `json:"offset,string"`
+		Size       uint64 `json:"size,string"`
+		Encryption string `json:"encryption"`
+		KeySize    int    `json:"key_size"`
+	} `json:"area"`
+	KDF luks2KDF `json:"kdf"`
+}
+
+type luks2AF struct {
+	Type    string `json:"type"`
+	Stripes int    `json:"stripes"`
+	Hash    string `json:"hash"`
+}
+
+type luks2KDF struct {
+	Type       string `json:"type"`
+	Salt       string `json:"salt"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	CPUs       uint8  `json:"cpus"`
+}
+
+type luks2Segment struct {
+	Type       string `json:"type"`
+	Offset     uint64 `json:"offset,string"`
+	Size       string `json:"size"`
+	IVTweak    uint64 `json:"iv_tweak,string"`
+	Encryption string `json:"encryption"`
+	SectorSize int    `json:"sector_size"`
+}
+
+type luks2Digest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       string   `json:"salt"`
+	Digest     string   `json:"digest"`
+}
+
+// LUKSOptions controls how OpenLUKS unlocks a device, either Passphrase or KeyFile must be set
+type LUKSOptions struct {
+	Passphrase []byte
+	// KeyFile is read as a whole and used as the passphrase, like cryptsetup --key-file does
+	KeyFile string
+	// ReadOnly creates a read-only crypt mapping
+	ReadOnly bool
+}
+
+// ReadLUKS2Header parses and verifies the LUKS2 header at the start of a device, like a mapped partition
+func ReadLUKS2Header(devicePath string) (*LUKS2Header, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", devicePath, err)
+	}
+	defer f.Close()
+	return readLUKS2Header(f)
+}
+
+func readLUKS2Header(r io.ReaderAt) (*LUKS2Header, error) {
+	bin := make([]byte, luks2BinaryHeaderSize)
+	if _, err := r.ReadAt(bin, 0); err != nil {
+		return nil, fmt.Errorf("reading LUKS2 header: %w", err)
+	}
+	if !bytes.Equal(bin[:6], []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}) || binary.BigEndian.Uint16(bin[6:8]) != 2 {
+		return nil, ErrNotLUKS2
+	}
+
+	hdrSize := binary.BigEndian.Uint64(bin[8:16])
+	// The header (binary part plus JSON area) is between 16KiB and 4MiB
+	if hdrSize < 4*luks2BinaryHeaderSize || hdrSize > 4<<20 {
+		return nil, fmt.Errorf("%w: header size %d out of range", ErrNotLUKS2, hdrSize)
+	}
+
+	full := make([]byte, hdrSize)
+	if _, err := r.ReadAt(full, 0); err != nil {
+		return nil, fmt.Errorf("reading LUKS2 metadata: %w", err)
+	}
+
+	// The checksum covers the whole header with the checksum field zeroed
+	csumAlg := cString(bin[72:104])
+	newHash := luksHash(csumAlg)
+	if newHash == nil {
+		return nil, fmt.Errorf("unsupported LUKS2 header checksum %q", csumAlg)
+	}
+	expected := make([]byte, luks2ChecksumLength)
+	copy(expected, full[luks2ChecksumOffset:luks2ChecksumOffset+luks2ChecksumLength])
+	copy(full[luks2ChecksumOffset:luks2ChecksumOffset+luks2ChecksumLength], make([]byte, luks2ChecksumLength))
+	h := newHash()
+	h.Write(full)
+	if sum := h.Sum(nil); !bytes.Equal(sum, expected[:len(sum)]) {
+		return nil, fmt.Errorf("LUKS2 header checksum mismatch")
+	}
+
+	hdr := &LUKS2Header{
+		UUID:       cString(bin[168:208]),
+		Label:      cString(bin[24:72]),
+		HeaderSize: hdrSize,
+	}
+	jsonArea := bytes.TrimRight(full[luks2BinaryHeaderSize:], "\x00")
+	if err := json.Unmarshal(jsonArea, &hdr.metadata); err != nil {
+		return nil, fmt.Errorf("parsing LUKS2 metadata: %w", err)
+	}
+
+	return hdr, nil
+}
+
+// Unlock recovers the volume key of the first crypt segment by trying every keyslot with the passphrase
+func (h *LUKS2Header) Unlock(r io.ReaderAt, passphrase []byte) ([]byte, error) {
+	segmentID, _, err := h.cryptSegment()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(h.metadata.Keyslots))
+	for id := range h.metadata.Keyslots {
+		ids = append(ids, id)
+	}
+	// Keyslots with a high priority are tried first, the ones with priority 0 are never used
+	sort.Slice(ids, func(i, j int) bool {
+		pi, pj := keyslotPriority(h.metadata.Keyslots[ids[i]]), keyslotPriority(h.metadata.Keyslots[ids[j]])
+		if pi != pj {
+			return pi > pj
+		}
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+
+	// Keyslots that cannot be used are skipped, another one may still open the device
+	var errs []error
+	var tried bool
+	for _, id := range ids {
+		ks := h.metadata.Keyslots[id]
+		if keyslotPriority(ks) == 0 {
+			continue
+		}
+		digest, ok := h.digestFor(id, segmentID)
+		if !ok {
+			continue
+		}
+		key, err := unlockKeyslot(r, ks, passphrase)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("keyslot %s: %w", id, err))
+			continue
+		}
+		ok, err = verifyDigest(digest, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("keyslot %s: %w", id, err))
+			continue
+		}
+		if ok {
+			return key, nil
+		}
+		clear(key)
+		tried = true
+	}
+
+	if !tried && len(errs) > 0 {
+		return nil, fmt.Errorf("no usable keyslot: %w", errors.Join(errs...))
+	}
+	return nil, ErrWrongPassphrase
+}
+
+// cryptSegment returns the first crypt segment, the one holding the data
+func (h *LUKS2Header) cryptSegment() (string, luks2Segment, error) {
+	ids := make([]string, 0, len(h.metadata.Segments))
+	for id := range h.metadata.Segments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if s := h.metadata.Segments[id]; s.Type == "crypt" {
+			return id, s, nil
+		}
+	}
+	return "", luks2Segment{}, fmt.Errorf("no crypt segment in LUKS2 header")
+}
+
+// digestFor returns the digest binding a keyslot to the data segment
+func (h *LUKS2Header) digestFor(keyslot, segmentID string) (luks2Digest, bool) {
+	for _, d := range h.metadata.Digests {
+		if contains(d.Keyslots, keyslot) && contains(d.Segments, segmentID) {
+			return d, true
+		}
+	}
+	return luks2Digest{}, false
+}
+
+func keyslotPriority(ks luks2Keyslot) int {
+	if ks.Priority == nil {
+		return 1
+	}
+	return *ks.Priority
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockKeyslot derives the keyslot key from the passphrase, decrypts the keyslot area and merges the AF stripes
+func unlockKeyslot(r io.ReaderAt, ks luks2Keyslot, passphrase []byte) ([]byte, error) {
+	if ks.Type != "luks2" || ks.AF.Type != "luks1" || ks.Area.Type != "raw" {
+		return nil, fmt.Errorf("unsupported keyslot type %s/%s/%s", ks.Type, ks.AF.Type, ks.Area.Type)
+	}
+	if ks.Area.Encryption != "aes-xts-plain64" {
+		return nil, fmt.Errorf("unsupported keyslot encryption %s", ks.Area.Encryption)
+	}
+	if ks.Area.KeySize != 32 && ks.Area.KeySize != 64 {
+		return nil, fmt.Errorf("invalid keyslot area key size %d", ks.Area.KeySize)
+	}
+	if ks.KeySize <= 0 || ks.KeySize > luks2MaxKeySize {
+		return nil, fmt.Errorf("invalid keyslot key size %d", ks.KeySize)
+	}
+	if ks.Area.Size > luks2MaxKeyslotsSize {
+		return nil, fmt.Errorf("keyslot area of %d bytes is larger than the %d bytes LUKS2 allows", ks.Area.Size, luks2MaxKeyslotsSize)
+	}
+	if ks.AF.Stripes <= 0 || uint64(ks.KeySize)*uint64(ks.AF.Stripes) > ks.Area.Size {
+		return nil, fmt.Errorf("keyslot area too small for %d stripes of %d bytes", ks.AF.Stripes, ks.KeySize)
+	}
+	if err := checkKDF(ks.KDF); err != nil {
+		return nil, err
+	}
+
+	afSize := ks.KeySize * ks.AF.Stripes
+	areaSize := (afSize + sectorSize - 1) / sectorSize * sectorSize
+	// Make sure the device holds the whole area before deriving keys and allocating for it
+	if ks.Area.Offset > math.MaxInt64-uint64(areaSize) {
+		return nil, fmt.Errorf("keyslot area offset %d out of range", ks.Area.Offset)
+	}
+	if _, err := r.ReadAt(make([]byte, 1), int64(ks.Area.Offset)+int64(areaSize)-1); err != nil {
+		return nil, fmt.Errorf("keyslot area at %d is beyond the end of the device: %w", ks.Area.Offset, err)
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(ks.KDF.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("decoding kdf salt: %w", err)
+	}
+
+	var areaKey []byte
+	switch ks.KDF.Type {
+	case "pbkdf2":
+		newHash := luksHash(ks.KDF.Hash)
+		if newHash == nil {
+			return nil, fmt.Errorf("unsupported pbkdf2 hash %s", ks.KDF.Hash)
+		}
+		areaKey, err = pbkdf2.Key(newHash, string(passphrase), salt, ks.KDF.Iterations, ks.Area.KeySize)
+		if err != nil {
+			return nil, err
+		}
+	case "argon2i":
+		areaKey = argon2.Key(passphrase, salt, ks.KDF.Time, ks.KDF.Memory, ks.KDF.CPUs, uint32(ks.Area.KeySize))
+	case "argon2id":
+		areaKey = argon2.IDKey(passphrase, salt, ks.KDF.Time, ks.KDF.Memory, ks.KDF.CPUs, uint32(ks.Area.KeySize))
+	default:
+		return nil, fmt.Errorf("unsupported kdf %s", ks.KDF.Type)
+	}
+
+	cipher, err := xts.NewCipher(aes.NewCipher, areaKey)
+	if err != nil {
+		return nil, fmt.Errorf("keyslot cipher: %w", err)
+	}
+
+	area := make([]byte, areaSize)
+	if _, err := r.ReadAt(area, int64(ks.Area.Offset)); err != nil {
+		return nil, fmt.Errorf("reading keyslot area: %w", err)
+	}
+	for i := 0; i < len(area)/sectorSize; i++ {
+		sector := area[i*sectorSize : (i+1)*sectorSize]
+		cipher.Decrypt(sector, sector, uint64(i))
+	}
+
+	newHash := luksHash(ks.AF.Hash)
+	if newHash == nil {
+		return nil, fmt.Errorf("unsupported AF hash %s", ks.AF.Hash)
+	}
+	return afMerge(area[:afSize], ks.KeySize, ks.AF.Stripes, newHash), nil
+}
+
+// checkKDF makes sure the keyslot kdf parameters are within the LUKS2 limits, argon2 panics on some of them
+func checkKDF(kdf luks2KDF) error {
+	switch kdf.Type {
+	case "pbkdf2":
+		if kdf.Iterations < 1 || kdf.Iterations > luks2MaxPBKDF2Iters {
+			return fmt.Errorf("pbkdf2 iterations %d out of range [1, %d]", kdf.Iterations, luks2MaxPBKDF2Iters)
+		}
+	case "argon2i", "argon2id":
+		if kdf.Time < 1 || kdf.Time > luks2MaxArgon2Time {
+			return fmt.Errorf("%s time %d out of range [1, %d]", kdf.Type, kdf.Time, luks2MaxArgon2Time)
+		}
+		if kdf.Memory < luks2MinArgon2Memory || kdf.Memory > luks2MaxArgon2Memory {
+			return fmt.Errorf("%s memory %dKiB out of range [%d, %d]", kdf.Type, kdf.Memory, luks2MinArgon2Memory, luks2MaxArgon2Memory)
+		}
+		if kdf.CPUs < 1 || kdf.CPUs > luks2MaxArgon2Threads {
+			return fmt.Errorf("%s cpus %d out of range [1, %d]", kdf.Type, kdf.CPUs, luks2MaxArgon2Threads)
+		}
+	}
+	return nil
+}
+
+// afMerge undoes the LUKS anti-forensic split: every stripe but the last is XORed and diffused, the last
+// XORed stripe gives the key back
+func afMerge(src []byte, blockSize, stripes int, newHash func() hash.Hash) []byte {
+	buf := make([]byte, blockSize)
+	for i := 0; i < stripes-1; i++ {
+		subtle.XORBytes(buf, buf, src[i*blockSize:(i+1)*blockSize])
+		afDiffuse(buf, newHash)
+	}
+	key := make([]byte, blockSize)
+	subtle.XORBytes(key, buf, src[(stripes-1)*blockSize:stripes*blockSize])
+	return key
+}
+
+// afDiffuse hashes buf in place, one digest sized block at a time, each prefixed by its big endian index
+func afDiffuse(buf []byte, newHash func() hash.Hash) {
+	h := newHash()
+	digestSize := h.Size()
+	var iv [4]byte
+	for i := 0; i*digestSize < len(buf); i++ {
+		end := min((i+1)*digestSize, len(buf))
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+		h.Reset()
+		h.Write(iv[:])
+		h.Write(buf[i*digestSize : end])
+		copy(buf[i*digestSize:end], h.Sum(nil))
+	}
+}
+
+// verifyDigest checks a candidate volume key against a pbkdf2 digest
+func verifyDigest(d luks2Digest, key []byte) (bool, error) {
+	if d.Type != "pbkdf2" {
+		return false, fmt.Errorf("unsupported digest type %s", d.Type)
+	}
+	newHash := luksHash(d.Hash)
+	if newHash == nil {
+		return false, fmt.Errorf("unsupported digest hash %s", d.Hash)
+	}
+	if d.Iterations < 1 || d.Iterations > luks2MaxPBKDF2Iters {
+		return false, fmt.Errorf("digest iterations %d out of range [1, %d]", d.Iterations, luks2MaxPBKDF2Iters)
+	}
+	salt, err := base64.StdEncoding.DecodeString(d.Salt)
+	if err != nil {
+		return false, fmt.Errorf("decoding digest salt: %w", err)
+	}
+	expected, err := base64.StdEncoding.DecodeString(d.Digest)
+	if err != nil {
+		return false, fmt.Errorf("decoding digest: %w", err)
+	}
+	got, err := pbkdf2.Key(newHash, string(key), salt, d.Iterations, len(expected))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(got, expected) == 1, nil
+}
+
+func luksHash(name string) func() hash.Hash {
+	switch strings.ToLower(name) {
+	case "sha1":
+		return sha1.New
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	}
+	return nil
+}
+
+// OpenLUKS unlocks the LUKS2 device (usually a partition mapping like /dev/mapper/loop0p2) and stacks a crypt
+// mapping with the given name on top of it. It returns the path of the decrypted device.
+func OpenLUKS(ctx context.Context, device, name string, opts LUKSOptions, log Logger) (string, error) {
+	passphrase := opts.Passphrase
+	if opts.KeyFile != "" {
+		data, err := os.ReadFile(opts.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("reading key file: %w", err)
+		}
+		passphrase = data
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("a passphrase or a key file is needed to unlock %s", device)
+	}
+
+	f, err := os.Open(device)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", device, err)
+	}
+	defer f.Close()
+
+	hdr, err := readLUKS2Header(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", device, err)
+	}
+
+	log.Printf("Unlocking LUKS2 device %s", device)
+	key, err := hdr.Unlock(f, passphrase)
+	if err != nil {
+		return "", fmt.Errorf("unlocking %s: %w", device, err)
+	}
+	defer clear(key)
+
+	_, segment, err := hdr.cryptSegment()
+	if err != nil {
+		return "", err
+	}
+
+	var length uint64
+	if segment.Size == "dynamic" {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return "", fmt.Errorf("getting size of %s: %w", device, err)
+		}
+		if uint64(size) <= segment.Offset {
+			return "", fmt.Errorf("%s is smaller than its LUKS2 data offset", device)
+		}
+		length = (uint64(size) - segment.Offset) / sectorSize
+	} else {
+		size, err := strconv.ParseUint(segment.Size, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid segment size %q", segment.Size)
+		}
+		length = size / sectorSize
+	}
+
+	// <cipher> <key> <iv_offset> <device> <offset> [<#opt_params> <opt_params>]
+	params := fmt.Sprintf("%s %s %d %s %d", segment.Encryption, hex.EncodeToString(key), segment.IVTweak, device, segment.Offset/sectorSize)
+	if segment.SectorSize > sectorSize {
+		params += fmt.Sprintf(" 1 sector_size:%d", segment.SectorSize)
+	}
+
+	log.Printf("Creating crypt mapping %s on %s", name, device)
+	err = dmCreate(ctx, dmDevice{
+		Name:     name,
+		UUID:     fmt.Sprintf("CRYPT-LUKS2-%s-%s", strings.ReplaceAll(hdr.UUID, "-", ""), name),
+		Targets:  []Target{{Length: length, Type: "crypt", Params: params}},
+		ReadOnly: opts.ReadOnly,
+		Secure:   true,
+		Backing:  device,
+	}, log)
+	if err != nil {
+		return "", err
+	}
+
+	return mappingPath(name), nil
+}
+
+// CloseLUKS removes a crypt mapping created by OpenLUKS
+func CloseLUKS(name string, log Logger) error {
+	return Remove(name, log)
+}
@@ -0,0 +1,179 @@
+package loopback
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/xts"
+)
+
+// buildLUKS2 writes a minimal LUKS2 image with a single pbkdf2 keyslot holding volumeKey
+func buildLUKS2(t *testing.T, passphrase, volumeKey []byte) []byte {
+	t.Helper()
+
+	const (
+		hdrSize    = 16384
+		areaOffset = 32768
+		stripes    = 4
+		iterations = 1000
+	)
+	keySize := len(volumeKey)
+	img := make([]byte, areaOffset+4096)
+
+	// AF split: random stripes for all but the last one, which is chosen so that the merge gives the key back
+	af := make([]byte, keySize*stripes)
+	for i := range af[:keySize*(stripes-1)] {
+		af[i] = byte(i*7 + 3)
+	}
+	buf := make([]byte, keySize)
+	for i := 0; i < stripes-1; i++ {
+		subtle.XORBytes(buf, buf, af[i*keySize:(i+1)*keySize])
+		afDiffuse(buf, sha256.New)
+	}
+	subtle.XORBytes(af[(stripes-1)*keySize:], buf, volumeKey)
+
+	kdfSalt := bytes.Repeat([]byte{0x11}, 32)
+	areaKey, err := pbkdf2.Key(sha256.New, string(passphrase), kdfSalt, iterations, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := xts.NewCipher(aes.NewCipher, areaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	area := img[areaOffset : areaOffset+(len(af)+sectorSize-1)/sectorSize*sectorSize]
+	copy(area, af)
+	for i := 0; i < len(area)/sectorSize; i++ {
+		cipher.Encrypt(area[i*sectorSize:(i+1)*sectorSize], area[i*sectorSize:(i+1)*sectorSize], uint64(i))
+	}
+
+	digestSalt := bytes.Repeat([]byte{0x22}, 32)
+	digest, err := pbkdf2.Key(sha256.New, string(volumeKey), digestSalt, iterations, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := fmt.Sprintf(`{
+		"keyslots": {"0": {"type": "luks2", "key_size": %d,
+			"af": {"type": "luks1", "stripes": %d, "hash": "sha256"},
+			"area": {"type": "raw", "offset": "%d", "size": "4096", "encryption": "aes-xts-plain64", "key_size": 64},
+			"kdf": {"type": "pbkdf2", "hash": "sha256", "iterations": %d, "salt": "%s"}}},
+		"segments": {"0": {"type": "crypt", "offset": "%d", "size": "dynamic", "iv_tweak": "0", "encryption": "aes-xts-plain64", "sector_size": 512}},
+		"digests": {"0": {"type": "pbkdf2", "keyslots": ["0"], "segments": ["0"], "hash": "sha256", "iterations": %d,
+			"salt": "%s", "digest": "%s"}}
+	}`, keySize, stripes, areaOffset, iterations, base64.StdEncoding.EncodeToString(kdfSalt),
+		areaOffset+4096, iterations, base64.StdEncoding.EncodeToString(digestSalt), base64.StdEncoding.EncodeToString(digest))
+
+	copy(img, []byte{'L', 'U', 'K', 'S', 0xba, 0xbe})
+	binary.BigEndian.PutUint16(img[6:], 2)
+	binary.BigEndian.PutUint64(img[8:], hdrSize)
+	copy(img[24:], "secret")
+	copy(img[72:], "sha256")
+	copy(img[168:], "0d1e4f0c-2a38-4d4c-9c2e-2b5c8f1a7e10")
+	copy(img[luks2BinaryHeaderSize:], metadata)
+	sum := sha256.Sum256(img[:hdrSize])
+	copy(img[luks2ChecksumOffset:], sum[:])
+
+	return img
+}
+
+func TestLUKS2Unlock(t *testing.T) {
+	passphrase := []byte("correct horse")
+	volumeKey := bytes.Repeat([]byte{0xab, 0xcd}, 32)
+	img := buildLUKS2(t, passphrase, volumeKey)
+
+	hdr, err := readLUKS2Header(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("readLUKS2Header: %v", err)
+	}
+	if hdr.UUID != "0d1e4f0c-2a38-4d4c-9c2e-2b5c8f1a7e10" || hdr.Label != "secret" {
+		t.Errorf("unexpected header identity %q %q", hdr.UUID, hdr.Label)
+	}
+
+	key, err := hdr.Unlock(bytes.NewReader(img), passphrase)
+	if err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if !bytes.Equal(key, volumeKey) {
+		t.Errorf("recovered key %x, want %x", key, volumeKey)
+	}
+
+	if _, err := hdr.Unlock(bytes.NewReader(img), []byte("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Unlock with a wrong passphrase: got %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestLUKS2UnlockSkipsBadKeyslots(t *testing.T) {
+	passphrase := []byte("correct horse")
+	volumeKey := bytes.Repeat([]byte{0xab, 0xcd}, 32)
+	img := buildLUKS2(t, passphrase, volumeKey)
+	hdr, err := readLUKS2Header(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("readLUKS2Header: %v", err)
+	}
+
+	// Broken keyslots tried before the good one must not stop Unlock
+	good := hdr.metadata.Keyslots["0"]
+	priority := 2
+	broken := map[string]func(ks *luks2Keyslot){
+		"1": func(ks *luks2Keyslot) {
+			ks.KDF = luks2KDF{Type: "argon2id", Salt: good.KDF.Salt, Time: 0, Memory: 1024, CPUs: 1}
+		},
+		"2": func(ks *luks2Keyslot) {
+			ks.KDF = luks2KDF{Type: "argon2i", Salt: good.KDF.Salt, Time: 4, Memory: 1024, CPUs: 0}
+		},
+		"3": func(ks *luks2Keyslot) {
+			ks.KDF = luks2KDF{Type: "argon2id", Salt: good.KDF.Salt, Time: 4, Memory: 1 << 30, CPUs: 1}
+		},
+		"4": func(ks *luks2Keyslot) { ks.KDF.Iterations = 1 << 40 },
+		"5": func(ks *luks2Keyslot) { ks.Area.Size = 1 << 40; ks.AF.Stripes = 1 << 20 },
+		"6": func(ks *luks2Keyslot) { ks.Area.Offset = uint64(len(img)) },
+		"7": func(ks *luks2Keyslot) { ks.Area.Encryption = "twofish-xts-plain64" },
+	}
+	for id, breakIt := range broken {
+		ks := good
+		ks.Priority = &priority
+		breakIt(&ks)
+		if _, err := unlockKeyslot(bytes.NewReader(img), ks, passphrase); err == nil {
+			t.Errorf("keyslot %s: expected unlockKeyslot to fail", id)
+		}
+		hdr.metadata.Keyslots[id] = ks
+		d := hdr.metadata.Digests["0"]
+		d.Keyslots = append(d.Keyslots, id)
+		hdr.metadata.Digests["0"] = d
+	}
+
+	key, err := hdr.Unlock(bytes.NewReader(img), passphrase)
+	if err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if !bytes.Equal(key, volumeKey) {
+		t.Errorf("recovered key %x, want %x", key, volumeKey)
+	}
+
+	// With no usable keyslot left the reason is reported instead of a wrong passphrase
+	delete(hdr.metadata.Keyslots, "0")
+	if _, err := hdr.Unlock(bytes.NewReader(img), passphrase); err == nil || errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Unlock without usable keyslots: got %v", err)
+	}
+}
+
+func TestReadLUKS2HeaderChecksum(t *testing.T) {
+	img := buildLUKS2(t, []byte("pass"), make([]byte, 64))
+	img[luks2BinaryHeaderSize+10] ^= 0xff
+
+	if _, err := readLUKS2Header(bytes.NewReader(img)); err == nil {
+		t.Fatal("expected a checksum error for a corrupted header")
+	}
+	if _, err := readLUKS2Header(bytes.NewReader(make([]byte, 8192))); !errors.Is(err, ErrNotLUKS2) {
+		t.Errorf("got %v, want ErrNotLUKS2", err)
+	}
+}
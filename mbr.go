@@ -0,0 +1,167 @@
+package loopback
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	mbrTableOffset = 446
+	mbrEntrySize   = 16
+	// mbrMaxLogical stops extended boot record chains that loop or go on forever, like the kernel does
+	mbrMaxLogical = 256
+
+	mbrTypeProtective = 0xee
+)
+
+// ErrInvalidMBR is returned when an MBR partition entry or extended boot record is out of range or overlaps
+var ErrInvalidMBR = errors.New("invalid MBR partition table")
+
+// mbrExtended reports whether a partition type is an extended partition holding logical ones
+func mbrExtended(t uint8) bool {
+	return t == 0x05 || t == 0x0f || t == 0x85
+}
+
+// GetMBRPartitions reads the MBR partition table of a device or image file, including the logical partitions
+// in an extended one, which are numbered from 5 like the kernel does. Extended partitions themselves are not
+// listed. Like GetGPTPartitions it reads the device or image raw, see ReadMBRPartitions for other formats.
+func GetMBRPartitions(devicePath string) ([]Partition, error) {
+	disk, err := openRawDisk(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Close()
+
+	return ReadMBRPartitions(disk, disk.Size())
+}
+
+// ReadMBRPartitions parses the MBR found in r, which is size bytes long, see ReadGPTPartitions
+func ReadMBRPartitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	if size < sectorSize {
+		return nil, fmt.Errorf("%w, device too small to hold an MBR (%d bytes)", ErrNoMBR, size)
+	}
+	totalSectors := uint64(size) / sectorSize
+
+	entries, err := readMBRTable(r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := []Partition{}
+	var extended bool
+	for i, e := range entries {
+		if e.Type == mbrTypeProtective {
+			return nil, fmt.Errorf("%w, protective MBR of a GPT disk", ErrNoMBR)
+		}
+		if e.Type == 0 || e.Sectors == 0 {
+			continue
+		}
+		if e.Start+e.Sectors > totalSectors {
+			return nil, mbrPartitionError(i+1, "sectors [%d, +%d) are outside the device (%d sectors)",
+				e.Start, e.Sectors, totalSectors)
+		}
+		if mbrExtended(e.Type) {
+			// Only the first extended partition is used, as the kernel does
+			if extended {
+				continue
+			}
+			extended = true
+			logical, err := readLogicalPartitions(r, e.Start, e.Start+e.Sectors)
+			if err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, logical...)
+			continue
+		}
+		partitions = append(partitions, e.partition(i+1))
+	}
+
+	var gptErr *GPTError
+	if err := checkOverlaps(partitions); errors.As(err, &gptErr) {
+		return nil, mbrPartitionError(gptErr.Partition, "%s", gptErr.Reason)
+	}
+
+	for i := range partitions {
+		partitions[i].Filesystem = probePartition(r, partitions[i])
+	}
+	return partitions, nil
+}
+
+// readLogicalPartitions follows the chain of extended boot records of the extended partition spanning
+// [start, end). Each one describes a logical partition relative to itself and links to the next one relative
+// to the start of the extended partition.
+func readLogicalPartitions(r io.ReaderAt, start, end uint64) ([]Partition, error) {
+	var partitions []Partition
+	ebr := start
+	for number := 5; ; number++ {
+		if number-5 >= mbrMaxLogical {
+			return nil, mbrPartitionError(number, "more than %d logical partitions", mbrMaxLogical)
+		}
+		entries, err := readMBRTable(r, ebr)
+		if err != nil {
+			return nil, fmt.Errorf("extended boot record at sector %d: %w", ebr, err)
+		}
+
+		if e := entries[0]; e.Type != 0 && e.Sectors != 0 {
+			first := ebr + e.Start
+			if first+e.Sectors > end {
+				return nil, mbrPartitionError(number, "sectors [%d, +%d) are outside the extended partition", first, e.Sectors)
+			}
+			e.Start = first
+			partitions = append(partitions, e.partition(number))
+		}
+
+		next := entries[1]
+		if !mbrExtended(next.Type) || next.Start == 0 {
+			return partitions, nil
+		}
+		// Links only move forward, which also rules out loops
+		if start+next.Start <= ebr || start+next.Start >= end {
+			return nil, mbrPartitionError(number, "next extended boot record at sector %d is out of order", start+next.Start)
+		}
+		ebr = start + next.Start
+	}
+}
+
+type mbrEntry struct {
+	Type    uint8
+	Start   uint64
+	Sectors uint64
+}
+
+func (e mbrEntry) partition(number int) Partition {
+	return Partition{
+		Number:     number,
+		MBRType:    e.Type,
+		FirstLBA:   e.Start,
+		LastLBA:    e.Start + e.Sectors - 1,
+		NumSectors: e.Sectors,
+	}
+}
+
+// readMBRTable reads the four entries of the MBR or extended boot record at sector lba
+func readMBRTable(r io.ReaderAt, lba uint64) ([4]mbrEntry, error) {
+	var entries [4]mbrEntry
+	buf := make([]byte, sectorSize)
+	if _, err := r.ReadAt(buf, int64(lba*sectorSize)); err != nil {
+		return entries, fmt.Errorf("reading MBR: %w", err)
+	}
+	if buf[510] != 0x55 || buf[511] != 0xaa {
+		return entries, fmt.Errorf("%w, not an MBR disk or blank image", ErrNoMBR)
+	}
+	for i := range entries {
+		e := buf[mbrTableOffset+i*mbrEntrySize:]
+		entries[i] = mbrEntry{
+			Type:    e[4],
+			Start:   uint64(binary.LittleEndian.Uint32(e[8:12])),
+			Sectors: uint64(binary.LittleEndian.Uint32(e[12:16])),
+		}
+	}
+	return entries, nil
+}
+
+func mbrPartitionError(number int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: partition %d: %s", ErrInvalidMBR, number, fmt.Sprintf(format, args...))
+}
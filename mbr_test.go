@@ -0,0 +1,85 @@
+package loopback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// putMBREntry fills entry i of the MBR or extended boot record at sector lba
+func putMBREntry(img []byte, lba uint64, i int, typ uint8, start, sectors uint32) {
+	e := img[lba*sectorSize+mbrTableOffset+uint64(i*mbrEntrySize):]
+	e[4] = typ
+	binary.LittleEndian.PutUint32(e[8:], start)
+	binary.LittleEndian.PutUint32(e[12:], sectors)
+	img[lba*sectorSize+510], img[lba*sectorSize+511] = 0x55, 0xaa
+}
+
+// buildTestMBR returns an 8192 sectors disk with a primary partition holding squashfs and an extended
+// partition with two logical ones
+func buildTestMBR() []byte {
+	img := make([]byte, 8192*sectorSize)
+	putMBREntry(img, 0, 0, 0x83, 2048, 2048)
+	putMBREntry(img, 0, 1, 0x05, 4096, 4096)
+	copy(img[2048*sectorSize:], "hsqs")
+
+	putMBREntry(img, 4096, 0, 0x83, 2, 2000)
+	putMBREntry(img, 4096, 1, 0x05, 2048, 2048)
+	putMBREntry(img, 6144, 0, 0x82, 2, 1000)
+	return img
+}
+
+func TestReadMBRPartitions(t *testing.T) {
+	img := buildTestMBR()
+
+	parts, err := ReadMBRPartitions(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("readMBRPartitions() failed: %v", err)
+	}
+	want := []Partition{
+		{Number: 1, MBRType: 0x83, FirstLBA: 2048, LastLBA: 4095, NumSectors: 2048},
+		{Number: 5, MBRType: 0x83, FirstLBA: 4098, LastLBA: 6097, NumSectors: 2000},
+		{Number: 6, MBRType: 0x82, FirstLBA: 6146, LastLBA: 7145, NumSectors: 1000},
+	}
+	if len(parts) != len(want) {
+		t.Fatalf("Expected %d partitions, got %+v", len(want), parts)
+	}
+	for i := range want {
+		fs := parts[i].Filesystem
+		parts[i].Filesystem = nil
+		if parts[i] != want[i] {
+			t.Fatalf("Expected %+v, got %+v", want[i], parts[i])
+		}
+		if (i == 0) != (fs != nil && fs.Type == "squashfs") {
+			t.Fatalf("Unexpected filesystem on partition %d: %+v", parts[i].Number, fs)
+		}
+	}
+}
+
+func TestReadMBRPartitionsRejectsHostileValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(img []byte)
+		want   error
+	}{
+		{"blank", func(img []byte) { clear(img) }, ErrNoMBR},
+		{"protective", func(img []byte) { putMBREntry(img, 0, 0, mbrTypeProtective, 1, 8191) }, ErrNoMBR},
+		{"beyond device", func(img []byte) { putMBREntry(img, 0, 0, 0x83, 2048, 10000) }, ErrInvalidMBR},
+		{"overlap", func(img []byte) { putMBREntry(img, 0, 2, 0x83, 4000, 10) }, ErrInvalidMBR},
+		{"ebr zero link ends the chain", func(img []byte) { putMBREntry(img, 6144, 1, 0x05, 0, 2048) }, nil},
+		{"ebr backwards", func(img []byte) { putMBREntry(img, 6144, 1, 0x05, 1, 2048) }, ErrInvalidMBR},
+		{"logical beyond extended", func(img []byte) { putMBREntry(img, 6144, 0, 0x83, 2, 4000) }, ErrInvalidMBR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := buildTestMBR()
+			tt.mutate(img)
+			_, err := ReadMBRPartitions(bytes.NewReader(img), int64(len(img)))
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
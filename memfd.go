@@ -0,0 +1,130 @@
+package loopback
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// memfdName is the name of the memfds created by LoopMemfd and LoopReader, it shows up in their backing file
+const memfdName = "loopback"
+
+// LoopFile attaches an already open file to a free loop device, so files without a path like memfds, or files
+// opened with special flags like O_DIRECT, can be used. The device is read-only if opts.ReadOnly is set or f was
+// opened read-only, f itself is left as is. The caller can close f once this returns, the loop device keeps its
+// own reference.
+func LoopFile(ctx context.Context, f *os.File, opts LoopOptions, log Logger) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// Paths cannot tell whether a file is attached already, the device and inode can
+	inUseBy, err := fileLoopDevice(f)
+	if err != nil {
+		log.Printf("Warning: Failed to check if image is in use: %v", err)
+	} else if inUseBy != "" {
+		return "", &ImageInUseError{Image: f.Name(), Device: inUseBy}
+	}
+
+	accessMode, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return "", fmt.Errorf("getting the access mode of %s: %w", f.Name(), err)
+	}
+	imageFile := f
+	if opts.ReadOnly && accessMode&unix.O_ACCMODE != unix.O_RDONLY {
+		if imageFile, err = openReadOnly(f); err != nil {
+			return "", err
+		}
+		defer imageFile.Close()
+	}
+
+	loopFile, err := attachFile(ctx, imageFile, f.Name(), 0, log)
+	if err != nil {
+		return "", err
+	}
+	defer loopFile.Close()
+	return loopFile.Name(), nil
+}
+
+// LoopMemfd attaches an empty memfd of size bytes to a free loop device, a scratch disk that lives in memory
+// (or swap) and is freed on Unloop
+func LoopMemfd(ctx context.Context, size int64, opts LoopOptions, log Logger) (string, error) {
+	if size <= 0 {
+		return "", fmt.Errorf("invalid memfd size %d", size)
+	}
+	f, err := newMemfd(memfdName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		return "", fmt.Errorf("sizing memfd to %d bytes: %w", size, err)
+	}
+	return LoopFile(ctx, f, opts, log)
+}
+
+// LoopReader copies an image from r into a memfd, leaving zero blocks as holes, and attaches it to a free loop
+// device. The memfd is freed on Unloop.
+func LoopReader(ctx context.Context, r io.Reader, opts LoopOptions, log Logger) (string, error) {
+	f, err := newMemfd(memfdName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := writeSparse(ctx, f, r); err != nil {
+		return "", fmt.Errorf("filling memfd: %w", err)
+	}
+	return LoopFile(ctx, f, opts, log)
+}
+
+// LoopBytes is LoopReader for an image held in memory, the loop device works on a copy of data
+func LoopBytes(ctx context.Context, data []byte, opts LoopOptions, log Logger) (string, error) {
+	return LoopReader(ctx, bytes.NewReader(data), opts, log)
+}
+
+// newMemfd creates an anonymous memory-backed file
+func newMemfd(name string) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("memfd_create: %w", err)
+	}
+	return os.NewFile(uintptr(fd), "/memfd:"+name), nil
+}
+
+// fileLoopDevice returns the loop device the open file is already attached to, or an empty string, by comparing
+// the device and inode numbers reported by the loop devices
+func fileLoopDevice(f *os.File) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return "", fmt.Errorf("stat %s: %w", f.Name(), err)
+	}
+
+	loopDirs, err := filepath.Glob("/sys/block/loop*")
+	if err != nil {
+		return "", fmt.Errorf("failed to list loop devices: %w", err)
+	}
+	for _, loopDir := range loopDirs {
+		// Only attached devices have a backing file
+		if _, err := loopBackingFile(loopDir); err != nil {
+			continue
+		}
+		loopDevice := filepath.Join("/dev", filepath.Base(loopDir))
+		loop, err := os.Open(loopDevice)
+		if err != nil {
+			continue
+		}
+		info, err := loopGetStatus(loop)
+		loop.Close()
+		if err == nil && info.Device == uint64(st.Dev) && info.Inode == uint64(st.Ino) {
+			return loopDevice, nil
+		}
+	}
+	return "", nil
+}
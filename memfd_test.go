@@ -0,0 +1,56 @@
+package loopback
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLoopMemfdInvalidSize(t *testing.T) {
+	if _, err := LoopMemfd(context.Background(), 0, LoopOptions{}, nopLogger{}); err == nil {
+		t.Fatalf("Expected an error for an empty memfd")
+	}
+}
+
+func TestFileLoopDeviceMemfd(t *testing.T) {
+	f, err := newMemfd(memfdName)
+	if err != nil {
+		t.Skipf("memfd_create is not available: %v", err)
+	}
+	defer f.Close()
+
+	// A fresh memfd cannot be attached anywhere yet
+	if device, err := fileLoopDevice(f); err != nil || device != "" {
+		t.Fatalf("fileLoopDevice() returned %q, %v", device, err)
+	}
+}
+
+func TestOpenReadOnlyMemfd(t *testing.T) {
+	f, err := newMemfd(memfdName)
+	if err != nil {
+		t.Skipf("memfd_create is not available: %v", err)
+	}
+	defer f.Close()
+	f.Write([]byte("data"))
+
+	ro, err := openReadOnly(f)
+	if err != nil {
+		t.Fatalf("openReadOnly() failed: %v", err)
+	}
+	defer ro.Close()
+	if mode, err := unix.FcntlInt(ro.Fd(), unix.F_GETFL, 0); err != nil || mode&unix.O_ACCMODE != unix.O_RDONLY {
+		t.Fatalf("Expected a read-only fd, got mode %#o (%v)", mode, err)
+	}
+	if _, err := ro.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatalf("Expected writes through the read-only fd to fail")
+	}
+	buf := make([]byte, 4)
+	if _, err := ro.ReadAt(buf, 0); err != nil || string(buf) != "data" {
+		t.Fatalf("Expected the memfd content, got %q (%v)", buf, err)
+	}
+	// The caller's fd stays usable
+	if _, err := f.WriteAt([]byte("D"), 0); err != nil {
+		t.Fatalf("Original fd was affected: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package loopback
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountOptions controls how MountPartition mounts a mapping
+type MountOptions struct {
+	// FSType overrides the detected filesystem type
+	FSType string
+	// ReadOnly mounts the filesystem read-only, this is forced if the mapping or its loop device are read-only
+	ReadOnly bool
+	// Flags are extra MS_* mount flags
+	Flags uintptr
+	// Data is the filesystem specific option string, like "noatime,discard"
+	Data string
+}
+
+// mountEntry is a single line of /proc/self/mountinfo
+type mountEntry struct {
+	Major      uint32
+	Minor      uint32
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+// MountPartition mounts the given mapping (either a name like loop0p1 or a full device path) on target,
+// detecting the filesystem type unless one is given in opts
+func MountPartition(mapping, target string, opts MountOptions, log Logger) error {
+	device := mappingPath(mapping)
+
+	fsType := opts.FSType
+	if fsType == "" {
+		fs, err := ProbeFilesystem(device)
+		if err != nil {
+			return fmt.Errorf("detecting filesystem on %s: %w", device, err)
+		}
+		fsType = fs.Type
+		log.Printf("Detected %s filesystem on %s", fsType, device)
+	}
+	if fsType == "swap" || fsType == "crypto_LUKS" {
+		return fmt.Errorf("%s holds %s which cannot be mounted", device, fsType)
+	}
+
+	flags := opts.Flags
+	if opts.ReadOnly {
+		flags |= unix.MS_RDONLY
+	} else if isReadOnlyDevice(device) {
+		log.Printf("Device %s is read-only, mounting read-only", device)
+		flags |= unix.MS_RDONLY
+	}
+
+	log.Printf("Mounting %s on %s", device, target)
+	if err := unix.Mount(device, target, fsType, flags, opts.Data); err != nil {
+		log.Printf("failed to mount %s", device)
+		return fmt.Errorf("mount %s on %s: %w", device, target, err)
+	}
+
+	return nil
+}
+
+// UnmountAll unmounts everything mounted from the loop device, its partitions and the mappings
+// stacked on top of it. Busy mounts are lazily detached so CleanupMappingsForDevice can run afterwards.
+func UnmountAll(loopDevice string, log Logger) error {
+	dir, err := sysBlockDir(loopDevice)
+	if err != nil {
+		return fmt.Errorf("device %s not found: %w", loopDevice, err)
+	}
+	devices, err := stackedDevices(filepath.Base(dir))
+	if err != nil {
+		return err
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+
+	var targets []string
+	for _, m := range mounts {
+		if devices[unix.Mkdev(m.Major, m.Minor)] {
+			targets = append(targets, m.MountPoint)
+		}
+	}
+	// Unmount nested mountpoints before their parents
+	sort.Slice(targets, func(i, j int) bool { return len(targets[i]) > len(targets[j]) })
+
+	var errs []error
+	for _, target := range targets {
+		log.Printf("Unmounting %s", target)
+		err := unix.Unmount(target, 0)
+		if err == nil {
+			continue
+		}
+		log.Printf("Failed to unmount %s (%v), detaching lazily", target, err)
+		if err := unix.Unmount(target, unix.MNT_DETACH); err != nil {
+			errs = append(errs, fmt.Errorf("unmount %s: %w", target, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// mappingPath returns the device path for a mapping name, full paths are returned as is
+func mappingPath(mapping string) string {
+	if filepath.IsAbs(mapping) {
+		return mapping
+	}
+	return filepath.Join("/dev/mapper", mapping)
+}
+
+// sysBlockDir resolves a device path (following /dev/mapper symlinks) to its /sys/class/block entry
+func sysBlockDir(device string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join("/sys/class/block", filepath.Base(resolved)), nil
+}
+
+// isReadOnlyDevice reports whether the device, or any device below it, is read-only
+func isReadOnlyDevice(device string) bool {
+	dir, err := sysBlockDir(device)
+	if err != nil {
+		return false
+	}
+	return sysReadOnly(dir)
+}
+
+func sysReadOnly(dir string) bool {
+	if ro, err := os.ReadFile(filepath.Join(dir, "ro")); err == nil && strings.TrimSpace(string(ro)) == "1" {
+		return true
+	}
+	slaves, _ := os.ReadDir(filepath.Join(dir, "slaves"))
+	for _, s := range slaves {
+		if sysReadOnly(filepath.Join("/sys/class/block", s.Name())) {
+			return true
+		}
+	}
+	return false
+}
+
+// stackedDevices returns the dev_t of the named block device, its partitions and every holder stacked on them
+func stackedDevices(name string) (map[uint64]bool, error) {
+	devices := map[uint64]bool{}
+	dir := filepath.Join("/sys/class/block", name)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("device %s not found: %w", name, err)
+	}
+
+	var walk func(name string)
+	walk = func(name string) {
+		dir := filepath.Join("/sys/class/block", name)
+		dev, err := readDevNumber(dir)
+		if err != nil || devices[dev] {
+			return
+		}
+		devices[dev] = true
+
+		// Kernel partitions show up as subdirectories named after the parent, like loop0p1
+		parts, _ := filepath.Glob(filepath.Join(dir, name+"p*"))
+		for _, p := range parts {
+			walk(filepath.Base(p))
+		}
+		holders, _ := os.ReadDir(filepath.Join(dir, "holders"))
+		for _, h := range holders {
+			walk(h.Name())
+		}
+	}
+	walk(name)
+
+	return devices, nil
+}
+
+// readDevNumber reads the major:minor of a /sys/class/block entry
+func readDevNumber(dir string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "dev"))
+	if err != nil {
+		return 0, err
+	}
+	var major, minor uint32
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &major, &minor); err != nil {
+		return 0, fmt.Errorf("parsing %s/dev: %w", dir, err)
+	}
+	return unix.Mkdev(major, minor), nil
+}
+
+// readMountInfo parses /proc/self/mountinfo
+func readMountInfo() ([]mountEntry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep == -1 || sep+2 >= len(fields) {
+			continue
+		}
+
+		majorMinor := strings.SplitN(fields[2], ":", 2)
+		if len(majorMinor) != 2 {
+			continue
+		}
+		major, err := strconv.ParseUint(majorMinor[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		minor, err := strconv.ParseUint(majorMinor[1], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		mounts = append(mounts, mountEntry{
+			Major:      uint32(major),
+			Minor:      uint32(minor),
+			MountPoint: unescapeMountPath(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for spaces and such) used in mountinfo
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,17 @@
+package loopback
+
+import "testing"
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := map[string]string{
+		"/mnt/plain":          "/mnt/plain",
+		`/mnt/with\040space`:  "/mnt/with space",
+		`/mnt/tab\011and\134`: "/mnt/tab\tand\\",
+		`/mnt/trailing\04`:    `/mnt/trailing\04`,
+	}
+	for in, want := range tests {
+		if got := unescapeMountPath(in); got != want {
+			t.Fatalf("unescapeMountPath(%q) = %q, expected %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package loopback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrUnknownFilesystem is returned when no known superblock is found on a device or partition
+var ErrUnknownFilesystem = errors.New("unknown or missing filesystem")
+
+// Filesystem describes what a partition holds, using the same type names as blkid
+type Filesystem struct {
+	Type  string
+	Label string
+	UUID  string
+}
+
+// prober checks r for a given superblock and returns nil if it does not match
+type prober func(r io.ReaderAt, size int64) *Filesystem
+
+// probers are tried in order, vfat goes last as its boot sector signature is the weakest
+var probers = []prober{
+	probeLUKS,
+	probeXFS,
+	probeSquashfs,
+	probeBtrfs,
+	probeExt,
+	probeErofs,
+	probeISO9660,
+	probeSwap,
+	probeVFAT,
+}
+
+// ProbeFilesystem detects the filesystem on the given device, like a /dev/mapper/loopXpY mapping
+func ProbeFilesystem(devicePath string) (*Filesystem, error) {
+	disk, err := openRawDisk(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Close()
+
+	fs, err := ProbeDiskFilesystem(disk)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", devicePath, err)
+	}
+	return fs, nil
+}
+
+// ProbeDiskFilesystem is ProbeFilesystem for a disk opened with OpenDisk
+func ProbeDiskFilesystem(d Disk) (*Filesystem, error) {
+	fs := probeFilesystem(d, d.Size())
+	if fs == nil {
+		return nil, ErrUnknownFilesystem
+	}
+	return fs, nil
+}
+
+// ProbePartition detects the filesystem of a partition by reading it at its offset in the image or device,
+// so no mapping is needed. The image is read raw, see ProbeDiskPartition for other formats.
+func ProbePartition(imagePath string, p Partition) (*Filesystem, error) {
+	disk, err := openRawDisk(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Close()
+
+	fs := probePartition(disk, p)
+	if fs == nil {
+		return nil, fmt.Errorf("partition %d of %s: %w", p.Number, imagePath, ErrUnknownFilesystem)
+	}
+	return fs, nil
+}
+
+// ProbeDiskPartition is ProbePartition for a disk opened with OpenDisk
+func ProbeDiskPartition(d Disk, p Partition) (*Filesystem, error) {
+	fs := probePartition(d, p)
+	if fs == nil {
+		return nil, fmt.Errorf("partition %d: %w", p.Number, ErrUnknownFilesystem)
+	}
+	return fs, nil
+}
+
+func probePartition(r io.ReaderAt, p Partition) *Filesystem {
+	size := int64(p.NumSectors * sectorSize)
+	return probeFilesystem(io.NewSectionReader(r, int64(p.FirstLBA*sectorSize), size), size)
+}
+
+func probeFilesystem(r io.ReaderAt, size int64) *Filesystem {
+	for _, probe := range probers {
+		if fs := probe(r, size); fs != nil {
+			return fs
+		}
+	}
+	return nil
+}
+
+// readBlock reads n bytes at off, returning nil if they are not all available
+func readBlock(r io.ReaderAt, size, off int64, n int) []byte {
+	if off < 0 || off+int64(n) > size {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil
+	}
+	return buf
+}
+
+// formatUUID renders 16 raw bytes as a canonical UUID, an all zero UUID is returned as empty
+func formatUUID(b []byte) string {
+	if len(b) != 16 || bytes.Equal(b, make([]byte, 16)) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// cString returns the string stored in b up to the first NUL byte
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func probeLUKS(r io.ReaderAt, size int64) *Filesystem {
+	hdr := readBlock(r, size, 0, 208)
+	if hdr == nil || !bytes.Equal(hdr[:6], []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}) {
+		return nil
+	}
+	fs := &Filesystem{Type: "crypto_LUKS", UUID: cString(hdr[168:208])}
+	// Only LUKS2 has a label, LUKS1 uses that space for the cipher name
+	if binary.BigEndian.Uint16(hdr[6:8]) == 2 {
+		fs.Label = cString(hdr[24:72])
+	}
+	return fs
+}
+
+func probeXFS(r io.ReaderAt, size int64) *Filesystem {
+	sb := readBlock(r, size, 0, 120)
+	if sb == nil || string(sb[:4]) != "XFSB" {
+		return nil
+	}
+	return &Filesystem{Type: "xfs", UUID: formatUUID(sb[32:48]), Label: cString(sb[108:120])}
+}
+
+func probeSquashfs(r io.ReaderAt, size int64) *Filesystem {
+	sb := readBlock(r, size, 0, 4)
+	if sb == nil || string(sb) != "hsqs" {
+		return nil
+	}
+	return &Filesystem{Type: "squashfs"}
+}
+
+func probeBtrfs(r io.ReaderAt, size int64) *Filesystem {
+	sb := readBlock(r, size, 0x10000, 0x12b+256)
+	if sb == nil || string(sb[0x40:0x48]) != "_BHRfS_M" {
+		return nil
+	}
+	return &Filesystem{Type: "btrfs", UUID: formatUUID(sb[0x20:0x30]), Label: cString(sb[0x12b:])}
+}
+
+const (
+	extCompatHasJournal    = 0x4
+	extIncompatExtents     = 0x40
+	extIncompat64Bit       = 0x80
+	extIncompatFlexBG      = 0x200
+	extRoCompatHugeFile    = 0x8
+	extRoCompatGdtCsum     = 0x10
+	extRoCompatDirNlink    = 0x20
+	extRoCompatExtraIsize  = 0x40
+	extRoCompatMetadataCsm = 0x400
+)
+
+func probeExt(r io.ReaderAt, size int64) *Filesystem {
+	sb := readBlock(r, size, 1024, 0x88)
+	if sb == nil || binary.LittleEndian.Uint16(sb[0x38:0x3a]) != 0xef53 {
+		return nil
+	}
+	compat := binary.LittleEndian.Uint32(sb[0x5c:0x60])
+	incompat := binary.LittleEndian.Uint32(sb[0x60:0x64])
+	roCompat := binary.LittleEndian.Uint32(sb[0x64:0x68])
+
+	// Same heuristic as blkid: any ext4-only feature makes it ext4, a journal alone makes it ext3
+	fsType := "ext2"
+	switch {
+	case incompat&(extIncompatExtents|extIncompat64Bit|extIncompatFlexBG) != 0,
+		roCompat&(extRoCompatHugeFile|extRoCompatGdtCsum|extRoCompatDirNlink|extRoCompatExtraIsize|extRoCompatMetadataCsm) != 0:
+		fsType = "ext4"
+	case compat&extCompatHasJournal != 0:
+		fsType = "ext3"
+	}
+	return &Filesystem{Type: fsType, UUID: formatUUID(sb[0x68:0x78]), Label: cString(sb[0x78:0x88])}
+}
+
+func probeErofs(r io.ReaderAt, size int64) *Filesystem {
+	sb := readBlock(r, size, 1024, 80)
+	if sb == nil || binary.LittleEndian.Uint32(sb[0:4]) != 0xe0f5e1e2 {
+		return nil
+	}
+	return &Filesystem{Type: "erofs", UUID: formatUUID(sb[48:64]), Label: cString(sb[64:80])}
+}
+
+func probeISO9660(r io.ReaderAt, size int64) *Filesystem {
+	pvd := readBlock(r, size, 0x8000, 830)
+	if pvd == nil || pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		return nil
+	}
+	fs := &Filesystem{Type: "iso9660", Label: strings.TrimRight(string(pvd[40:72]), " ")}
+	// There is no UUID on iso9660, blkid derives one from the creation date (YYYYMMDDHHMMSScc)
+	date := string(pvd[813:829])
+	if strings.Trim(date, "0") != "" {
+		fs.UUID = fmt.Sprintf("%s-%s-%s-%s-%s-%s-%s", date[0:4], date[4:6], date[6:8], date[8:10], date[10:12], date[12:14], date[14:16])
+	}
+	return fs
+}
+
+func probeSwap(r io.ReaderAt, size int64) *Filesystem {
+	// The signature sits at the end of the first page, which depends on the arch that ran mkswap
+	for _, pageSize := range []int64{4096, 8192, 16384, 65536} {
+		sig := readBlock(r, size, pageSize-10, 10)
+		if sig == nil {
+			return nil
+		}
+		switch string(sig) {
+		case "SWAPSPACE2":
+			hdr := readBlock(r, size, 1024, 44)
+			if hdr == nil {
+				return nil
+			}
+			return &Filesystem{Type: "swap", UUID: formatUUID(hdr[12:28]), Label: cString(hdr[28:44])}
+		case "SWAP-SPACE":
+			// Old v0 swap, no UUID nor label
+			return &Filesystem{Type: "swap"}
+		}
+	}
+	return nil
+}
+
+func probeVFAT(r io.ReaderAt, size int64) *Filesystem {
+	bs := readBlock(r, size, 0, sectorSize)
+	if bs == nil || bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil
+	}
+
+	var id uint32
+	var label string
+	switch {
+	case string(bs[82:87]) == "FAT32":
+		id = binary.LittleEndian.Uint32(bs[67:71])
+		label = string(bs[71:82])
+	case string(bs[54:57]) == "FAT":
+		id = binary.LittleEndian.Uint32(bs[39:43])
+		label = string(bs[43:54])
+	default:
+		return nil
+	}
+
+	label = strings.TrimRight(label, " ")
+	if label == "NO NAME" {
+		label = ""
+	}
+	return &Filesystem{Type: "vfat", UUID: fmt.Sprintf("%04X-%04X", id>>16, id&0xffff), Label: label}
+}
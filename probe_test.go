@@ -0,0 +1,76 @@
+package loopback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestProbeFilesystem(t *testing.T) {
+	ext4 := make([]byte, 8192)
+	binary.LittleEndian.PutUint16(ext4[1024+0x38:], 0xef53)
+	binary.LittleEndian.PutUint32(ext4[1024+0x60:], extIncompatExtents)
+	copy(ext4[1024+0x68:], []byte{0xca, 0x76, 0x33, 0xe4, 0xd9, 0x23, 0x49, 0x87, 0x96, 0xb3, 0x68, 0x15, 0xaf, 0xd3, 0x24, 0x3d})
+	copy(ext4[1024+0x78:], "rootfs")
+
+	ext3 := make([]byte, 8192)
+	binary.LittleEndian.PutUint16(ext3[1024+0x38:], 0xef53)
+	binary.LittleEndian.PutUint32(ext3[1024+0x5c:], extCompatHasJournal)
+
+	vfat := make([]byte, 8192)
+	copy(vfat[82:], "FAT32   ")
+	binary.LittleEndian.PutUint32(vfat[67:], 0x1234abcd)
+	copy(vfat[71:], "EFI        ")
+	vfat[510], vfat[511] = 0x55, 0xaa
+
+	tests := []struct {
+		name string
+		img  []byte
+		want Filesystem
+	}{
+		{"ext4", ext4, Filesystem{Type: "ext4", Label: "rootfs", UUID: "ca7633e4-d923-4987-96b3-6815afd3243d"}},
+		{"ext3", ext3, Filesystem{Type: "ext3"}},
+		{"vfat", vfat, Filesystem{Type: "vfat", Label: "EFI", UUID: "1234-ABCD"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := probeFilesystem(bytes.NewReader(tt.img), int64(len(tt.img)))
+			if fs == nil {
+				t.Fatalf("Expected %s to be detected, got nothing", tt.want.Type)
+			}
+			if *fs != tt.want {
+				t.Fatalf("Expected %+v, got %+v", tt.want, *fs)
+			}
+		})
+	}
+
+	if fs := probeFilesystem(bytes.NewReader(make([]byte, 8192)), 8192); fs != nil {
+		t.Fatalf("Expected blank data to not be detected, got %+v", fs)
+	}
+}
+
+func TestReadGPTPartitionsProbesFilesystems(t *testing.T) {
+	img := buildTestGPT(2048, 128, 128,
+		testGPTEntry{firstLBA: 34, lastLBA: 999},
+		testGPTEntry{firstLBA: 1000, lastLBA: 2014},
+	)
+	copy(img[1000*sectorSize:], "hsqs")
+
+	parts, err := ReadGPTPartitions(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("readGPTPartitions() failed: %v", err)
+	}
+	if parts[0].Filesystem != nil {
+		t.Fatalf("Expected no filesystem on partition 1, got %+v", parts[0].Filesystem)
+	}
+	if parts[1].Filesystem == nil || parts[1].Filesystem.Type != "squashfs" {
+		t.Fatalf("Expected squashfs on partition 2, got %+v", parts[1].Filesystem)
+	}
+
+	_, err = ProbeFilesystem("/tmp/does_not_exist.img")
+	if err == nil || errors.Is(err, ErrUnknownFilesystem) {
+		t.Fatalf("Expected an open error for a missing device, got %v", err)
+	}
+}
@@ -0,0 +1,541 @@
+package loopback
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	qcow2Magic          = "QFI\xfb"
+	qcow2MinClusterBits = 9
+	qcow2MaxClusterBits = 21
+	// qcow2MaxL1Size bounds the L1 table to 32MiB, like qemu does
+	qcow2MaxL1Size = 32 << 20 / 8
+	// qcow2MaxBackingDepth stops backing file loops
+	qcow2MaxBackingDepth = 16
+	// qcow2L2CacheSize is the number of L2 tables kept in memory
+	qcow2L2CacheSize = 64
+
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2FlagCompressed = 1 << 62
+	qcow2FlagZero       = 1
+
+	qcow2IncompatDirty       = 1 << 0
+	qcow2IncompatCorrupt     = 1 << 1
+	qcow2IncompatDataFile    = 1 << 2
+	qcow2IncompatCompression = 1 << 3
+	qcow2IncompatExtendedL2  = 1 << 4
+
+	qcow2CompressionZlib = 0
+	qcow2CompressionZstd = 1
+)
+
+var (
+	// ErrInvalidQcow2 is returned when a qcow2 image header or table is malformed or uses unsupported features
+	ErrInvalidQcow2 = errors.New("invalid qcow2 image")
+	// ErrQcow2Backing is returned when a qcow2 image has a backing file that is not allowed
+	ErrQcow2Backing = errors.New("qcow2 backing file not allowed")
+)
+
+// Qcow2Options controls how OpenQcow2WithOptions treats backing files. The backing file name comes from the
+// image itself, so by default images with one are rejected.
+type Qcow2Options struct {
+	// AllowBacking follows backing files, as long as they are regular files in the directory of the image
+	// referring to them (or below it), named by a relative path without "..", symlinks included
+	AllowBacking bool
+}
+
+// Qcow2Image reads the virtual disk of a qcow2 image, following its backing file chain
+type Qcow2Image struct {
+	f           *os.File
+	size        int64
+	clusterBits uint32
+	clusterSize int64
+	compression uint8
+	l1          []uint64
+	backingFile string
+	backing     io.ReaderAt
+	backingSize int64
+	closers     []io.Closer
+
+	refcountTableOffset   uint64
+	refcountTableClusters uint32
+	refcountOrder         uint32
+
+	mu      sync.Mutex
+	l2Cache map[uint64][]uint64
+}
+
+// OpenQcow2 opens a qcow2 (version 2 or 3) image, images with a backing file are rejected with ErrQcow2Backing
+func OpenQcow2(path string) (*Qcow2Image, error) {
+	return OpenQcow2WithOptions(path, Qcow2Options{})
+}
+
+// OpenQcow2WithOptions is OpenQcow2 with control over backing files
+func OpenQcow2WithOptions(path string, opts Qcow2Options) (*Qcow2Image, error) {
+	return openQcow2(path, opts, 0)
+}
+
+func openQcow2(path string, opts Qcow2Options, depth int) (*Qcow2Image, error) {
+	if depth > qcow2MaxBackingDepth {
+		return nil, fmt.Errorf("%w: backing chain deeper than %d", ErrInvalidQcow2, qcow2MaxBackingDepth)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	q := &Qcow2Image{f: f, closers: []io.Closer{f}, l2Cache: map[uint64][]uint64{}}
+	if err := q.readHeader(path, opts, depth); err != nil {
+		q.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return q, nil
+}
+
+func (q *Qcow2Image) readHeader(path string, opts Qcow2Options, depth int) error {
+	hdr := make([]byte, 112)
+	if n, err := q.f.ReadAt(hdr, 0); n < 72 {
+		return fmt.Errorf("reading qcow2 header: %w", err)
+	}
+	if string(hdr[0:4]) != qcow2Magic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidQcow2)
+	}
+
+	version := binary.BigEndian.Uint32(hdr[4:8])
+	if version != 2 && version != 3 {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidQcow2, version)
+	}
+	backingOffset := binary.BigEndian.Uint64(hdr[8:16])
+	backingSize := binary.BigEndian.Uint32(hdr[16:20])
+	q.clusterBits = binary.BigEndian.Uint32(hdr[20:24])
+	if q.clusterBits < qcow2MinClusterBits || q.clusterBits > qcow2MaxClusterBits {
+		return fmt.Errorf("%w: cluster bits %d out of range", ErrInvalidQcow2, q.clusterBits)
+	}
+	q.clusterSize = 1 << q.clusterBits
+	size := binary.BigEndian.Uint64(hdr[24:32])
+	if size > 1<<62 {
+		return fmt.Errorf("%w: virtual size %d too large", ErrInvalidQcow2, size)
+	}
+	q.size = int64(size)
+	if crypt := binary.BigEndian.Uint32(hdr[32:36]); crypt != 0 {
+		return fmt.Errorf("%w: encrypted images are not supported", ErrInvalidQcow2)
+	}
+	l1Size := binary.BigEndian.Uint32(hdr[36:40])
+	l1Offset := binary.BigEndian.Uint64(hdr[40:48])
+	q.refcountTableOffset = binary.BigEndian.Uint64(hdr[48:56])
+	q.refcountTableClusters = binary.BigEndian.Uint32(hdr[56:60])
+	q.refcountOrder = 4
+
+	if version == 3 {
+		incompatible := binary.BigEndian.Uint64(hdr[72:80])
+		q.refcountOrder = binary.BigEndian.Uint32(hdr[96:100])
+		headerLength := binary.BigEndian.Uint32(hdr[100:104])
+		if q.refcountOrder > 6 {
+			return fmt.Errorf("%w: refcount order %d out of range", ErrInvalidQcow2, q.refcountOrder)
+		}
+		switch {
+		case incompatible&qcow2IncompatCorrupt != 0:
+			return fmt.Errorf("%w: image is marked corrupt", ErrInvalidQcow2)
+		case incompatible&qcow2IncompatDataFile != 0:
+			return fmt.Errorf("%w: external data files are not supported", ErrInvalidQcow2)
+		case incompatible&qcow2IncompatExtendedL2 != 0:
+			return fmt.Errorf("%w: extended L2 entries are not supported", ErrInvalidQcow2)
+		case incompatible&^(qcow2IncompatDirty|qcow2IncompatCompression) != 0:
+			return fmt.Errorf("%w: unknown incompatible features %#x", ErrInvalidQcow2, incompatible)
+		}
+		if incompatible&qcow2IncompatCompression != 0 {
+			if headerLength <= 104 {
+				return fmt.Errorf("%w: compression type flagged but missing", ErrInvalidQcow2)
+			}
+			q.compression = hdr[104]
+		}
+		if q.compression != qcow2CompressionZlib && q.compression != qcow2CompressionZstd {
+			return fmt.Errorf("%w: unknown compression type %d", ErrInvalidQcow2, q.compression)
+		}
+	}
+
+	// Each L2 table covers clusterSize/8 clusters, the L1 table must cover the whole virtual disk
+	l2Coverage := uint64(q.clusterSize) / 8 * uint64(q.clusterSize)
+	if need := (size + l2Coverage - 1) / l2Coverage; uint64(l1Size) < need || l1Size > qcow2MaxL1Size {
+		return fmt.Errorf("%w: L1 table of %d entries for %d bytes", ErrInvalidQcow2, l1Size, size)
+	}
+	l1Buf := make([]byte, int(l1Size)*8)
+	if _, err := q.f.ReadAt(l1Buf, int64(l1Offset)); err != nil {
+		return fmt.Errorf("reading L1 table: %w", err)
+	}
+	q.l1 = make([]uint64, l1Size)
+	for i := range q.l1 {
+		q.l1[i] = binary.BigEndian.Uint64(l1Buf[i*8:])
+	}
+
+	if backingOffset != 0 {
+		if backingSize == 0 || backingSize > 1023 {
+			return fmt.Errorf("%w: backing file name of %d bytes", ErrInvalidQcow2, backingSize)
+		}
+		name := make([]byte, backingSize)
+		if _, err := q.f.ReadAt(name, int64(backingOffset)); err != nil {
+			return fmt.Errorf("reading backing file name: %w", err)
+		}
+		q.backingFile = string(name)
+		if !opts.AllowBacking {
+			return fmt.Errorf("%w: %q", ErrQcow2Backing, q.backingFile)
+		}
+		backingPath, err := qcow2BackingPath(path, q.backingFile)
+		if err != nil {
+			return err
+		}
+		if err := q.openBacking(backingPath, opts, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qcow2BackingPath resolves the backing file name recorded in the image at path, it must stay in the directory
+// of the image once symlinks are followed
+func qcow2BackingPath(path, name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%w: %q is not a relative path below the image directory", ErrQcow2Backing, name)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("opening backing file: %w", err)
+	}
+	if rel, err := filepath.Rel(dir, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %q leads out of the image directory", ErrQcow2Backing, name)
+	}
+	// Block devices, FIFOs and other special files are never used as backing files
+	if st, err := os.Stat(resolved); err != nil || !st.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: %q is not a regular file", ErrQcow2Backing, name)
+	}
+	return resolved, nil
+}
+
+// openBacking opens the backing file, either another qcow2 image or a raw one
+func (q *Qcow2Image) openBacking(path string, opts Qcow2Options, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening backing file: %w", err)
+	}
+	// It could have been replaced since qcow2BackingPath checked it
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		f.Close()
+		return fmt.Errorf("%w: %s is not a regular file", ErrQcow2Backing, path)
+	}
+	magic := make([]byte, 4)
+	_, err = f.ReadAt(magic, 0)
+	if err == nil && string(magic) == qcow2Magic {
+		f.Close()
+		b, err := openQcow2(path, opts, depth+1)
+		if err != nil {
+			return err
+		}
+		q.backing, q.backingSize = b, b.size
+		q.closers = append(q.closers, b)
+		return nil
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("getting size of backing file: %w", err)
+	}
+	q.backing, q.backingSize = f, size
+	q.closers = append(q.closers, f)
+	return nil
+}
+
+// Size returns the size of the virtual disk
+func (q *Qcow2Image) Size() int64 {
+	return q.size
+}
+
+// BackingFile returns the backing file name as recorded in the image, empty if there is none
+func (q *Qcow2Image) BackingFile() string {
+	return q.backingFile
+}
+
+// Close closes the image and its backing files
+func (q *Qcow2Image) Close() error {
+	var errs []error
+	for _, c := range q.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ReadAt reads the virtual disk, unallocated clusters read from the backing file or as zeroes
+func (q *Qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= q.size {
+		return 0, io.EOF
+	}
+
+	var n int
+	for n < len(p) && off < q.size {
+		inCluster := off & (q.clusterSize - 1)
+		chunk := min(int64(len(p)-n), q.clusterSize-inCluster, q.size-off)
+		if err := q.readCluster(p[n:n+int(chunk)], off, inCluster); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		off += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readCluster fills p with the data at off, which all lies in one cluster
+func (q *Qcow2Image) readCluster(p []byte, off, inCluster int64) error {
+	entry, err := q.l2Entry(off)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry&qcow2FlagCompressed != 0:
+		data, err := q.readCompressed(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inCluster:])
+	case entry&qcow2FlagZero != 0:
+		clear(p)
+	case entry&qcow2OffsetMask != 0:
+		host := int64(entry&qcow2OffsetMask) + inCluster
+		if _, err := q.f.ReadAt(p, host); err != nil {
+			return fmt.Errorf("reading cluster at %d: %w", host, err)
+		}
+	default:
+		return q.readBacking(p, off)
+	}
+	return nil
+}
+
+// readBacking reads unallocated data from the backing file, past its end the disk reads as zeroes
+func (q *Qcow2Image) readBacking(p []byte, off int64) error {
+	clear(p)
+	if q.backing == nil || off >= q.backingSize {
+		return nil
+	}
+	end := min(int64(len(p)), q.backingSize-off)
+	if _, err := q.backing.ReadAt(p[:end], off); err != nil && err != io.EOF {
+		return fmt.Errorf("reading backing file: %w", err)
+	}
+	return nil
+}
+
+// l2Entry returns the L2 entry for the cluster holding the virtual offset, 0 when unallocated
+func (q *Qcow2Image) l2Entry(off int64) (uint64, error) {
+	l2Bits := q.clusterBits - 3
+	cluster := uint64(off) >> q.clusterBits
+	l1Index := cluster >> l2Bits
+	l2Index := cluster & (1<<l2Bits - 1)
+
+	l2Offset := q.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	table, err := q.l2Table(l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	return table[l2Index], nil
+}
+
+// l2Table reads an L2 table through a small cache
+func (q *Qcow2Image) l2Table(offset uint64) ([]uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if table, ok := q.l2Cache[offset]; ok {
+		return table, nil
+	}
+	if offset%uint64(q.clusterSize) != 0 {
+		return nil, fmt.Errorf("%w: unaligned L2 table at %d", ErrInvalidQcow2, offset)
+	}
+
+	buf := make([]byte, q.clusterSize)
+	if _, err := q.f.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("reading L2 table at %d: %w", offset, err)
+	}
+	table := make([]uint64, q.clusterSize/8)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+
+	if len(q.l2Cache) >= qcow2L2CacheSize {
+		clear(q.l2Cache)
+	}
+	q.l2Cache[offset] = table
+	return table, nil
+}
+
+// compressedLocation decodes a compressed cluster descriptor into the host offset and the bytes to read
+func (q *Qcow2Image) compressedLocation(entry uint64) (int64, int64) {
+	sizeShift := 62 - (q.clusterBits - 8)
+	host := entry & (1<<sizeShift - 1)
+	sectors := (entry>>sizeShift)&(1<<(62-sizeShift)-1) + 1
+	return int64(host), int64(sectors*sectorSize) - int64(host&(sectorSize-1))
+}
+
+// readCompressed reads and inflates a compressed cluster
+func (q *Qcow2Image) readCompressed(entry uint64) ([]byte, error) {
+	host, length := q.compressedLocation(entry)
+	buf := make([]byte, length)
+	n, err := q.f.ReadAt(buf, host)
+	// The last compressed cluster may end before the announced sectors
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading compressed cluster at %d: %w", host, err)
+	}
+	buf = buf[:n]
+
+	out := make([]byte, q.clusterSize)
+	var r io.Reader
+	switch q.compression {
+	case qcow2CompressionZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(buf), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		r = dec
+	default:
+		// zlib clusters are raw deflate streams, without the zlib header
+		r = flate.NewReader(bytes.NewReader(buf))
+	}
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, fmt.Errorf("%w: decompressing cluster at %d: %v", ErrInvalidQcow2, host, err)
+	}
+	return out, nil
+}
+
+// Check verifies that every cluster referenced by the L1 and L2 tables lies in the file and has a non-zero
+// refcount, like a read-only `qemu-img check` for leaks aside
+func (q *Qcow2Image) Check() error {
+	refcount, err := q.refcounts()
+	if err != nil {
+		return err
+	}
+
+	st, err := q.f.Stat()
+	if err != nil {
+		return err
+	}
+	check := func(what string, offset uint64) error {
+		if offset >= uint64(st.Size()) {
+			return fmt.Errorf("%w: %s at %d is past the end of the file", ErrInvalidQcow2, what, offset)
+		}
+		if rc, err := refcount(offset >> q.clusterBits); err != nil {
+			return err
+		} else if rc == 0 {
+			return fmt.Errorf("%w: %s at %d has a zero refcount", ErrInvalidQcow2, what, offset)
+		}
+		return nil
+	}
+
+	for _, l1 := range q.l1 {
+		l2Offset := l1 & qcow2OffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		if err := check("L2 table", l2Offset); err != nil {
+			return err
+		}
+		table, err := q.l2Table(l2Offset)
+		if err != nil {
+			return err
+		}
+		for _, entry := range table {
+			var host uint64
+			switch {
+			case entry&qcow2FlagCompressed != 0:
+				h, _ := q.compressedLocation(entry)
+				host = uint64(h)
+			default:
+				host = entry & qcow2OffsetMask
+			}
+			if host == 0 {
+				continue
+			}
+			if err := check("data cluster", host); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refcounts loads the refcount table and returns a lookup of the refcount of a host cluster
+func (q *Qcow2Image) refcounts() (func(cluster uint64) (uint64, error), error) {
+	tableSize := int64(q.refcountTableClusters) * q.clusterSize
+	if q.refcountTableOffset == 0 || tableSize == 0 || tableSize > qcow2MaxL1Size*8 {
+		return nil, fmt.Errorf("%w: refcount table of %d bytes at %d", ErrInvalidQcow2, tableSize, q.refcountTableOffset)
+	}
+	buf := make([]byte, tableSize)
+	if _, err := q.f.ReadAt(buf, int64(q.refcountTableOffset)); err != nil {
+		return nil, fmt.Errorf("reading refcount table: %w", err)
+	}
+
+	bits := uint64(1) << q.refcountOrder
+	perBlock := uint64(q.clusterSize) * 8 / bits
+	blocks := map[uint64][]byte{}
+
+	return func(cluster uint64) (uint64, error) {
+		index := cluster / perBlock
+		if index >= uint64(len(buf)/8) {
+			return 0, nil
+		}
+		blockOffset := binary.BigEndian.Uint64(buf[index*8:]) & qcow2OffsetMask
+		if blockOffset == 0 {
+			return 0, nil
+		}
+		block, ok := blocks[blockOffset]
+		if !ok {
+			block = make([]byte, q.clusterSize)
+			if _, err := q.f.ReadAt(block, int64(blockOffset)); err != nil {
+				return 0, fmt.Errorf("reading refcount block at %d: %w", blockOffset, err)
+			}
+			blocks[blockOffset] = block
+		}
+
+		// Refcounts of a byte or more are big endian, narrower ones are packed starting from the low bits
+		bit := (cluster % perBlock) * bits
+		switch bits {
+		case 64:
+			return binary.BigEndian.Uint64(block[bit/8:]), nil
+		case 32:
+			return uint64(binary.BigEndian.Uint32(block[bit/8:])), nil
+		case 16:
+			return uint64(binary.BigEndian.Uint16(block[bit/8:])), nil
+		case 8:
+			return uint64(block[bit/8]), nil
+		default:
+			return uint64(block[bit/8]>>(bit%8)) & (1<<bits - 1), nil
+		}
+	}, nil
+}
+
+// ConvertToRaw writes the virtual disk to a sparse raw file that Loop can attach, zero clusters become holes
+func (q *Qcow2Image) ConvertToRaw(dst string) error {
+	return ConvertToRaw(q, dst)
+}
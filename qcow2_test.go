@@ -0,0 +1,167 @@
+package loopback
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// buildTestQcow2 writes a qcow2 v3 image with 4KiB clusters and a 64KiB virtual disk backed by a raw file:
+// cluster 0 is allocated, 1 comes from the backing file, 2 is compressed, 3 is a zero cluster and the rest is
+// unallocated. It returns the image path and the expected virtual disk.
+func buildTestQcow2(t *testing.T) (string, []byte) {
+	t.Helper()
+	const clusterSize = 4096
+	dir := t.TempDir()
+
+	want := make([]byte, 16*clusterSize)
+	backing := bytes.Repeat([]byte{0xbb}, 16*clusterSize)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), backing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	copy(want, backing)
+
+	img := make([]byte, 7*clusterSize)
+	hdr := img[:clusterSize]
+	copy(hdr, qcow2Magic)
+	binary.BigEndian.PutUint32(hdr[4:], 3)
+	binary.BigEndian.PutUint64(hdr[8:], 200)
+	binary.BigEndian.PutUint32(hdr[16:], uint32(len("base.raw")))
+	copy(hdr[200:], "base.raw")
+	binary.BigEndian.PutUint32(hdr[20:], 12)
+	binary.BigEndian.PutUint64(hdr[24:], uint64(len(want)))
+	binary.BigEndian.PutUint32(hdr[36:], 1)
+	binary.BigEndian.PutUint64(hdr[40:], 1*clusterSize)
+	binary.BigEndian.PutUint64(hdr[48:], 2*clusterSize)
+	binary.BigEndian.PutUint32(hdr[56:], 1)
+	binary.BigEndian.PutUint32(hdr[96:], 4)
+	binary.BigEndian.PutUint32(hdr[100:], 104)
+
+	binary.BigEndian.PutUint64(img[1*clusterSize:], 4*clusterSize|1<<63)
+	binary.BigEndian.PutUint64(img[2*clusterSize:], 3*clusterSize)
+	for i := 0; i < 7; i++ {
+		binary.BigEndian.PutUint16(img[3*clusterSize+2*i:], 1)
+	}
+
+	l2 := img[4*clusterSize : 5*clusterSize]
+	data := bytes.Repeat([]byte("allocated "), clusterSize/10+1)[:clusterSize]
+	copy(img[5*clusterSize:], data)
+	copy(want, data)
+	binary.BigEndian.PutUint64(l2[0:], 5*clusterSize|1<<63)
+
+	compressed := bytes.Repeat([]byte("compressed"), clusterSize/10+1)[:clusterSize]
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	w.Write(compressed)
+	w.Close()
+	copy(img[6*clusterSize:], deflated.Bytes())
+	copy(want[2*clusterSize:], compressed)
+	sectors := uint64((deflated.Len()+sectorSize-1)/sectorSize - 1)
+	binary.BigEndian.PutUint64(l2[16:], qcow2FlagCompressed|sectors<<(62-(12-8))|6*clusterSize)
+
+	binary.BigEndian.PutUint64(l2[24:], qcow2FlagZero)
+	clear(want[3*clusterSize : 4*clusterSize])
+
+	path := filepath.Join(dir, "disk.qcow2")
+	if err := os.WriteFile(path, img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, want
+}
+
+func TestQcow2Read(t *testing.T) {
+	path, want := buildTestQcow2(t)
+
+	q, err := OpenQcow2WithOptions(path, Qcow2Options{AllowBacking: true})
+	if err != nil {
+		t.Fatalf("OpenQcow2() failed: %v", err)
+	}
+	defer q.Close()
+
+	if q.Size() != int64(len(want)) || q.BackingFile() != "base.raw" {
+		t.Fatalf("Unexpected image: size %d, backing %q", q.Size(), q.BackingFile())
+	}
+	got := make([]byte, len(want))
+	if _, err := q.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt() failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Virtual disk content mismatch")
+	}
+	// A read crossing clusters
+	if _, err := q.ReadAt(got[:100], 4096-50); err != nil || !bytes.Equal(got[:100], want[4096-50:4096+50]) {
+		t.Fatalf("Unaligned read mismatch: %v", err)
+	}
+	if err := q.Check(); err != nil {
+		t.Fatalf("Check() failed: %v", err)
+	}
+
+	raw := filepath.Join(t.TempDir(), "disk.raw")
+	if err := q.ConvertToRaw(raw); err != nil {
+		t.Fatalf("ConvertToRaw() failed: %v", err)
+	}
+	converted, err := os.ReadFile(raw)
+	if err != nil || !bytes.Equal(converted, want) {
+		t.Fatalf("Raw conversion mismatch: %v", err)
+	}
+}
+
+func TestQcow2CheckRefcount(t *testing.T) {
+	path, _ := buildTestQcow2(t)
+	img, _ := os.ReadFile(path)
+	// Drop the refcount of the allocated data cluster
+	binary.BigEndian.PutUint16(img[3*4096+2*5:], 0)
+	os.WriteFile(path, img, 0o644)
+
+	q, err := OpenQcow2WithOptions(path, Qcow2Options{AllowBacking: true})
+	if err != nil {
+		t.Fatalf("OpenQcow2() failed: %v", err)
+	}
+	defer q.Close()
+	if err := q.Check(); !errors.Is(err, ErrInvalidQcow2) {
+		t.Fatalf("Expected ErrInvalidQcow2, got %v", err)
+	}
+}
+
+func TestQcow2InvalidHeader(t *testing.T) {
+	path, _ := buildTestQcow2(t)
+	img, _ := os.ReadFile(path)
+	binary.BigEndian.PutUint32(img[20:], 40)
+	os.WriteFile(path, img, 0o644)
+
+	if _, err := OpenQcow2(path); !errors.Is(err, ErrInvalidQcow2) {
+		t.Fatalf("Expected ErrInvalidQcow2 for bad cluster bits, got %v", err)
+	}
+}
+
+func TestQcow2BackingFile(t *testing.T) {
+	path, _ := buildTestQcow2(t)
+	allow := Qcow2Options{AllowBacking: true}
+
+	if _, err := OpenQcow2(path); !errors.Is(err, ErrQcow2Backing) {
+		t.Fatalf("Expected ErrQcow2Backing by default, got %v", err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "outside.raw")
+	os.WriteFile(outside, make([]byte, 4096), 0o644)
+	os.Symlink(outside, filepath.Join(filepath.Dir(path), "link.raw"))
+	os.Symlink("/dev/null", filepath.Join(filepath.Dir(path), "null.raw"))
+	syscall.Mkfifo(filepath.Join(filepath.Dir(path), "fifo.raw"), 0o644)
+
+	img, _ := os.ReadFile(path)
+	for _, name := range []string{outside, "../" + filepath.Base(filepath.Dir(outside)) + "/outside.raw", "link.raw", "null.raw", "fifo.raw"} {
+		patched := append([]byte{}, img...)
+		binary.BigEndian.PutUint32(patched[16:], uint32(len(name)))
+		copy(patched[200:], name)
+		os.WriteFile(path, patched, 0o644)
+
+		if _, err := OpenQcow2WithOptions(path, allow); !errors.Is(err, ErrQcow2Backing) {
+			t.Errorf("Backing file %q: expected ErrQcow2Backing, got %v", name, err)
+		}
+	}
+}
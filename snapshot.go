@@ -0,0 +1,297 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSnapshotChunkSize is the copy-on-write granularity in sectors, 8KiB like lvcreate uses
+const defaultSnapshotChunkSize = 16
+
+// SnapshotOptions controls how CreateSnapshot sets up a snapshot
+type SnapshotOptions struct {
+	// COWSize is the size of the COW file when it has to be created, defaults to the size of the base image
+	COWSize int64
+	// ChunkSize is the copy-on-write granularity in 512 bytes sectors, defaults to 16
+	ChunkSize uint32
+	// Mergeable attaches the base image read-write so the changes can be merged back into it with Merge.
+	// Otherwise the base image is attached read-only and is never written to.
+	Mergeable bool
+}
+
+// Snapshot is a writable copy-on-write view of a base image, writes only ever land in the COW file
+type Snapshot struct {
+	name     string
+	baseLoop string
+	cowLoop  string
+	cowFile  string
+	opts     SnapshotOptions
+	log      Logger
+	// originCreated and snapshotCreated tell which mappings are ours to remove, a mapping that already had the
+	// name when CreateSnapshot ran belongs to someone else
+	originCreated   bool
+	snapshotCreated bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// CreateSnapshot attaches baseImage and cowFile to loop devices and stacks a persistent snapshot called name on
+// them, with a snapshot-origin mapping called name-origin exposing the unmodified base. The COW file is created
+// sparse when missing, an existing one is reused so a snapshot survives being closed and created again.
+func CreateSnapshot(ctx context.Context, baseImage, cowFile, name string, opts SnapshotOptions, log Logger) (*Snapshot, error) {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = defaultSnapshotChunkSize
+	}
+	if !isPowerOfTwo(opts.ChunkSize) {
+		return nil, fmt.Errorf("snapshot chunk size %d is not a power of two", opts.ChunkSize)
+	}
+
+	created, err := createCOWFile(baseImage, cowFile, opts.COWSize, log)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{name: name, cowFile: cowFile, opts: opts, log: log}
+	// A COW file we just created holds nothing worth keeping if the setup fails
+	rollback := func() {
+		if created {
+			s.Discard()
+		} else {
+			s.Close()
+		}
+	}
+
+	s.baseLoop, err = LoopWithOptions(ctx, baseImage, LoopOptions{ReadOnly: !opts.Mergeable}, log)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("attaching %s: %w", baseImage, err)
+	}
+	s.cowLoop, err = LoopWithOptions(ctx, cowFile, LoopOptions{}, log)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("attaching %s: %w", cowFile, err)
+	}
+
+	sectors, err := deviceSectors(s.baseLoop)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+
+	err = dmCreate(ctx, dmDevice{
+		Name:     s.originName(),
+		Targets:  []Target{s.originTarget(sectors)},
+		ReadOnly: !opts.Mergeable,
+		Backing:  s.baseLoop,
+	}, log)
+	if err == nil {
+		s.originCreated = true
+		err = s.createSnapshotDevice(ctx, sectors)
+	}
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// createCOWFile creates a sparse COW file of the given size, or the size of the base image, unless it exists.
+// It reports whether the file was created.
+func createCOWFile(baseImage, cowFile string, size int64, log Logger) (bool, error) {
+	if size <= 0 {
+		st, err := os.Stat(baseImage)
+		if err != nil {
+			return false, err
+		}
+		size = st.Size()
+	}
+	return createSparseFile(cowFile, size, log)
+}
+
+// deviceSectors returns the size of a block device in 512 bytes sectors
+func deviceSectors(device string) (uint64, error) {
+	dir, err := sysBlockDir(device)
+	if err != nil {
+		return 0, fmt.Errorf("device %s not found: %w", device, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "size"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (s *Snapshot) originName() string {
+	return s.name + "-origin"
+}
+
+func (s *Snapshot) originTarget(sectors uint64) Target {
+	return Target{Length: sectors, Type: "snapshot-origin", Params: s.baseLoop}
+}
+
+// createSnapshotDevice creates the writable snapshot mapping
+func (s *Snapshot) createSnapshotDevice(ctx context.Context, sectors uint64) error {
+	// <origin> <COW device> <persistent> <chunksize>
+	err := dmCreate(ctx, dmDevice{
+		Name:    s.name,
+		Targets: []Target{{Length: sectors, Type: "snapshot", Params: fmt.Sprintf("%s %s P %d", s.baseLoop, s.cowLoop, s.opts.ChunkSize)}},
+		Backing: s.baseLoop,
+	}, s.log)
+	s.snapshotCreated = err == nil
+	return err
+}
+
+// Path returns the /dev/mapper path of the writable snapshot
+func (s *Snapshot) Path() string {
+	return mappingPath(s.name)
+}
+
+// OriginPath returns the /dev/mapper path of the unmodified base image
+func (s *Snapshot) OriginPath() string {
+	return mappingPath(s.originName())
+}
+
+// BaseDevice returns the loop device of the base image
+func (s *Snapshot) BaseDevice() string {
+	return s.baseLoop
+}
+
+// COWDevice returns the loop device of the COW file
+func (s *Snapshot) COWDevice() string {
+	return s.cowLoop
+}
+
+// Merge writes the changes held in the COW file back into the base image, waiting until the kernel is done.
+// The snapshot must not be in use, it is recreated empty on top of the merged base afterwards.
+func (s *Snapshot) Merge(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("snapshot %s is closed", s.name)
+	}
+	if !s.opts.Mergeable {
+		return fmt.Errorf("snapshot %s was created without Mergeable, its base image is read-only", s.name)
+	}
+
+	sectors, err := deviceSectors(s.baseLoop)
+	if err != nil {
+		return err
+	}
+
+	s.log.Printf("Merging snapshot %s into %s", s.name, s.baseLoop)
+	if err := s.removeDevice(s.name); err != nil {
+		return err
+	}
+	s.snapshotCreated = false
+
+	merge := Target{Length: sectors, Type: "snapshot-merge", Params: fmt.Sprintf("%s %s P %d", s.baseLoop, s.cowLoop, s.opts.ChunkSize)}
+	if err := dmReplaceTable(s.originName(), []Target{merge}); err != nil {
+		return err
+	}
+
+	mergeErr := s.waitMerged(ctx)
+	if mergeErr != nil && ctx.Err() != nil {
+		// The kernel keeps merging in the background, leave the merge target in place
+		return mergeErr
+	}
+
+	if err := dmReplaceTable(s.originName(), []Target{s.originTarget(sectors)}); err != nil {
+		return errors.Join(mergeErr, err)
+	}
+	return errors.Join(mergeErr, s.createSnapshotDevice(ctx, sectors))
+}
+
+// waitMerged polls the snapshot-merge status until only the COW metadata is left
+func (s *Snapshot) waitMerged(ctx context.Context) error {
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+	for {
+		targets, err := dmTargets(s.originName(), true)
+		if err != nil {
+			return err
+		}
+		if len(targets) != 1 {
+			return fmt.Errorf("unexpected status for %s: %+v", s.originName(), targets)
+		}
+		// <sectors_allocated>/<total_sectors> <metadata_sectors>, or Invalid/Merge failed
+		var allocated, total, metadata uint64
+		if _, err := fmt.Sscanf(targets[0].Params, "%d/%d %d", &allocated, &total, &metadata); err != nil {
+			return fmt.Errorf("merging %s: %s", s.name, targets[0].Params)
+		}
+		if allocated == metadata {
+			s.log.Printf("Snapshot %s merged", s.name)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("merging %s: %w", s.name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeDevice removes one of the snapshot mappings, it is fine if it is already gone
+func (s *Snapshot) removeDevice(name string) error {
+	if _, err := os.Stat(mappingPath(name)); os.IsNotExist(err) {
+		return nil
+	}
+	nodes := lookupMappingNodes(name)
+	if err := removeMapping(name, false); err != nil {
+		return err
+	}
+	nodes.remove(s.log)
+	journalRemove(journalKindMapping, name, s.log)
+	return nil
+}
+
+// Close removes the snapshot mappings and detaches both loop devices, keeping the COW file.
+// Every step runs even if a previous one failed and all errors are returned. Calling Close again is a no-op.
+func (s *Snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var errs []error
+	for _, m := range []struct {
+		name    string
+		created bool
+	}{{s.name, s.snapshotCreated}, {s.originName(), s.originCreated}} {
+		if !m.created {
+			continue
+		}
+		if err := s.removeDevice(m.name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, dev := range []string{s.cowLoop, s.baseLoop} {
+		if dev == "" {
+			continue
+		}
+		if err := Unloop(dev, s.log); err != nil {
+			errs = append(errs, fmt.Errorf("detaching %s: %w", dev, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Discard closes the snapshot and deletes the COW file, throwing the changes away
+func (s *Snapshot) Discard() error {
+	err := s.Close()
+	if rmErr := os.Remove(s.cowFile); rmErr != nil && !os.IsNotExist(rmErr) {
+		err = errors.Join(err, rmErr)
+	}
+	return err
+}
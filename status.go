@@ -0,0 +1,155 @@
+package loopback
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Loop device flags as reported by GetStatus and changed by SetFlags
+const (
+	FlagReadOnly  = unix.LO_FLAGS_READ_ONLY
+	FlagAutoclear = unix.LO_FLAGS_AUTOCLEAR
+	FlagPartScan  = unix.LO_FLAGS_PARTSCAN
+	FlagDirectIO  = unix.LO_FLAGS_DIRECT_IO
+)
+
+// LoopStatus is the state of an attached loop device
+type LoopStatus struct {
+	// Number is N in /dev/loopN
+	Number uint32
+	// BackingFile is the image attached to the device
+	BackingFile string
+	// Offset is where the device starts in the backing file, in bytes
+	Offset uint64
+	// SizeLimit is the maximum size of the device in bytes, 0 means up to the end of the backing file
+	SizeLimit uint64
+	// Flags is a combination of the Flag* constants
+	Flags uint32
+}
+
+func (s *LoopStatus) ReadOnly() bool  { return s.Flags&FlagReadOnly != 0 }
+func (s *LoopStatus) Autoclear() bool { return s.Flags&FlagAutoclear != 0 }
+func (s *LoopStatus) PartScan() bool  { return s.Flags&FlagPartScan != 0 }
+func (s *LoopStatus) DirectIO() bool  { return s.Flags&FlagDirectIO != 0 }
+
+// GetStatus returns the status of an attached loop device
+func GetStatus(loopDevice string) (*LoopStatus, error) {
+	f, err := os.Open(loopDevice)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := loopGetStatus(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// The name in the status is truncated to 63 bytes and only set if the attacher filled it, sysfs has the full path
+	backingFile, err := loopBackingFile(loopDevice)
+	if err != nil {
+		backingFile = cString(info.File_name[:])
+	}
+
+	return &LoopStatus{
+		Number:      info.Number,
+		BackingFile: backingFile,
+		Offset:      info.Offset,
+		SizeLimit:   info.Sizelimit,
+		Flags:       info.Flags,
+	}, nil
+}
+
+// SetStatus changes the offset, size limit and flags of a live loop device without detaching it.
+// Only autoclear, partscan and direct I/O can be changed on an attached device, the read-only flag is fixed at attach time.
+// Autoclear cannot be turned on here: the device is opened just for the call and the kernel would detach it as
+// soon as it is closed again, unless something else holds it. Use SetStatusFile with a held device instead.
+func SetStatus(loopDevice string, status LoopStatus, log Logger) error {
+	f, err := os.Open(loopDevice)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return setStatus(f, status, false, log)
+}
+
+// SetStatusFile is SetStatus on a loop device the caller keeps open, autoclear can be turned on: the kernel then
+// detaches the device once loop and every other opener are closed
+func SetStatusFile(loop *os.File, status LoopStatus, log Logger) error {
+	return setStatus(loop, status, true, log)
+}
+
+func setStatus(f *os.File, status LoopStatus, held bool, log Logger) error {
+	loopDevice := f.Name()
+	info, err := loopGetStatus(f)
+	if err != nil {
+		return err
+	}
+	if (info.Flags^status.Flags)&FlagReadOnly != 0 {
+		return fmt.Errorf("read-only flag of %s cannot be changed while attached", loopDevice)
+	}
+	if !held && info.Flags&FlagAutoclear == 0 && status.Flags&FlagAutoclear != 0 {
+		return fmt.Errorf("setting autoclear on %s would detach it once closed, use SetStatusFile or SetFlagsFile on a held device", loopDevice)
+	}
+
+	// Direct I/O has its own ioctl, LOOP_SET_STATUS64 ignores it
+	if (info.Flags^status.Flags)&FlagDirectIO != 0 {
+		log.Printf("Setting direct I/O on %s to %t", loopDevice, status.DirectIO())
+		if err := loopSetDirectIO(f, status.DirectIO()); err != nil {
+			return err
+		}
+	}
+
+	info.Offset = status.Offset
+	info.Sizelimit = status.SizeLimit
+	info.Flags = status.Flags &^ FlagDirectIO
+	log.Printf("Setting status of %s (offset %d, size limit %d, flags %#x)", loopDevice, info.Offset, info.Sizelimit, info.Flags)
+	return loopSetStatus(f, info)
+}
+
+// SetFlags sets and clears flags on a live loop device, flags present in both set and clear end up set.
+// Like SetStatus it refuses to turn autoclear on, see SetFlagsFile.
+func SetFlags(loopDevice string, set, clear uint32, log Logger) error {
+	status, err := GetStatus(loopDevice)
+	if err != nil {
+		return err
+	}
+	status.Flags = status.Flags&^clear | set
+	return SetStatus(loopDevice, *status, log)
+}
+
+// SetFlagsFile is SetFlags on a loop device the caller keeps open, see SetStatusFile
+func SetFlagsFile(loop *os.File, set, clear uint32, log Logger) error {
+	status, err := GetStatus(loop.Name())
+	if err != nil {
+		return err
+	}
+	status.Flags = status.Flags&^clear | set
+	return SetStatusFile(loop, *status, log)
+}
+
+// SetDirectIO switches direct I/O on the backing file on or off
+func SetDirectIO(loopDevice string, enabled bool, log Logger) error {
+	f, err := os.Open(loopDevice)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("Setting direct I/O on %s to %t", loopDevice, enabled)
+	return loopSetDirectIO(f, enabled)
+}
+
+// SetBlockSize changes the logical block size of the loop device, it must be a power of two between 512 and the page size
+func SetBlockSize(loopDevice string, size uint32, log Logger) error {
+	f, err := os.Open(loopDevice)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("Setting block size of %s to %d", loopDevice, size)
+	return loopSetBlockSize(f, size)
+}
@@ -0,0 +1,339 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// defaultThinBlockSize is the pool allocation unit in sectors, 64KiB like lvcreate uses
+	defaultThinBlockSize = 128
+	// defaultThinMetadataSize is enough metadata for pools of hundreds of GiB
+	defaultThinMetadataSize = 64 << 20
+	// thinMaxDeviceID is the largest thin device id the pool accepts, ids are 24 bits
+	thinMaxDeviceID = 1<<24 - 1
+)
+
+// ThinPoolOptions controls how CreateThinPool sets up a pool
+type ThinPoolOptions struct {
+	// DataSize is the size of the data file when it has to be created
+	DataSize int64
+	// MetadataSize is the size of the metadata file when it has to be created, defaults to 64MiB
+	MetadataSize int64
+	// BlockSize is the allocation unit in 512 bytes sectors, a multiple of 128 that defaults to 128
+	BlockSize uint32
+	// LowWaterMark is the number of free blocks under which the kernel raises an event
+	LowWaterMark uint64
+}
+
+// ThinPool is a dm-thin pool backed by a data and a metadata file, from which thin volumes, clones of base
+// images and snapshots are carved. Blocks are only allocated when written.
+type ThinPool struct {
+	name     string
+	dataLoop string
+	metaLoop string
+	log      Logger
+
+	mu      sync.Mutex
+	closed  bool
+	volumes map[string]thinVolume
+	// origins holds the read-only loop devices of the base images clones are made from
+	origins map[string]string
+}
+
+type thinVolume struct {
+	id      uint32
+	sectors uint64
+	// origin is the external origin device reads of unprovisioned blocks come from, if any
+	origin string
+}
+
+// CreateThinPool attaches dataFile and metadataFile to loop devices and creates a thin-pool mapping called name on
+// them. Missing files are created sparse, existing ones are reused so the thin volumes they hold survive the pool
+// being closed and created again.
+func CreateThinPool(ctx context.Context, name, dataFile, metadataFile string, opts ThinPoolOptions, log Logger) (*ThinPool, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = defaultThinBlockSize
+	}
+	if opts.BlockSize%defaultThinBlockSize != 0 {
+		return nil, fmt.Errorf("thin pool block size %d is not a multiple of %d sectors", opts.BlockSize, defaultThinBlockSize)
+	}
+	if opts.MetadataSize <= 0 {
+		opts.MetadataSize = defaultThinMetadataSize
+	}
+	if _, err := os.Stat(dataFile); os.IsNotExist(err) && opts.DataSize <= 0 {
+		return nil, fmt.Errorf("a data size is needed to create %s", dataFile)
+	}
+
+	p := &ThinPool{name: name, log: log, volumes: map[string]thinVolume{}, origins: map[string]string{}}
+
+	var created []string
+	// poolCreated tells the pool mapping is ours: until then a mapping called name belongs to someone else and
+	// must be left alone, only our loop devices are detached
+	var poolCreated bool
+	// Files we just created hold nothing worth keeping if the setup fails
+	rollback := func() {
+		if poolCreated {
+			p.Close()
+		} else {
+			for _, dev := range []string{p.dataLoop, p.metaLoop} {
+				if dev == "" {
+					continue
+				}
+				if err := Unloop(dev, log); err != nil {
+					log.Printf("Failed to detach %s: %v", dev, err)
+				}
+			}
+		}
+		for _, f := range created {
+			os.Remove(f)
+		}
+	}
+
+	for _, f := range []struct {
+		path string
+		size int64
+		loop *string
+	}{{metadataFile, opts.MetadataSize, &p.metaLoop}, {dataFile, opts.DataSize, &p.dataLoop}} {
+		// A new metadata file must read back as zeroes, which a sparse file does
+		isNew, err := createSparseFile(f.path, f.size, log)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if isNew {
+			created = append(created, f.path)
+		}
+		*f.loop, err = LoopWithOptions(ctx, f.path, LoopOptions{}, log)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("attaching %s: %w", f.path, err)
+		}
+	}
+
+	sectors, err := deviceSectors(p.dataLoop)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	sectors -= sectors % uint64(opts.BlockSize)
+	if sectors == 0 {
+		rollback()
+		return nil, fmt.Errorf("%s is smaller than a pool block", dataFile)
+	}
+
+	// <metadata dev> <data dev> <data block size> <low water mark>
+	err = dmCreate(ctx, dmDevice{
+		Name: name,
+		Targets: []Target{{Length: sectors, Type: "thin-pool",
+			Params: fmt.Sprintf("%s %s %d %d", p.metaLoop, p.dataLoop, opts.BlockSize, opts.LowWaterMark)}},
+		Backing: p.dataLoop,
+	}, log)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	poolCreated = true
+
+	return p, nil
+}
+
+// createSparseFile creates a sparse file of the given size unless it exists, and reports whether it was created
+func createSparseFile(path string, size int64, log Logger) (bool, error) {
+	if _, err := os.Stat(path); err == nil {
+		log.Printf("Reusing %s", path)
+		return false, nil
+	}
+
+	log.Printf("Creating sparse file %s of %d bytes", path, size)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return false, fmt.Errorf("creating %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		os.Remove(path)
+		return false, fmt.Errorf("sizing %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// Path returns the /dev/mapper path of the pool
+func (p *ThinPool) Path() string {
+	return mappingPath(p.name)
+}
+
+// CreateVolume creates an empty thin volume of the given size in sectors with a pool-unique 24 bits id, and
+// activates it as a mapping called name. It returns the path of the volume.
+func (p *ThinPool) CreateVolume(ctx context.Context, id uint32, name string, sectors uint64) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.createThin(id, fmt.Sprintf("create_thin %d", id)); err != nil {
+		return "", err
+	}
+	return p.activate(ctx, name, thinVolume{id: id, sectors: sectors}, true)
+}
+
+// CreateClone creates a thin volume that starts as a copy of baseImage without copying it: the image is attached
+// read-only once per pool and used as the external origin of the volume, and only the blocks written to the clone
+// are allocated in the pool. The clone can be partitioned with CreateMappingsFromDevice.
+func (p *ThinPool) CreateClone(ctx context.Context, id uint32, name, baseImage string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	origin, ok := p.origins[baseImage]
+	if !ok {
+		var err error
+		origin, err = LoopWithOptions(ctx, baseImage, LoopOptions{ReadOnly: true}, p.log)
+		if err != nil {
+			return "", fmt.Errorf("attaching %s: %w", baseImage, err)
+		}
+		p.origins[baseImage] = origin
+	}
+	sectors, err := deviceSectors(origin)
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.createThin(id, fmt.Sprintf("create_thin %d", id)); err != nil {
+		return "", err
+	}
+	return p.activate(ctx, name, thinVolume{id: id, sectors: sectors, origin: origin}, true)
+}
+
+// CreateSnapshot creates a thin snapshot with the given id of the active volume called origin, and activates it
+// as a mapping called name. The origin is suspended while the snapshot is taken.
+func (p *ThinPool) CreateSnapshot(ctx context.Context, id uint32, name, origin string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vol, ok := p.volumes[origin]
+	if !ok {
+		return "", fmt.Errorf("thin volume %s not found in pool %s", origin, p.name)
+	}
+
+	if err := Suspend(origin); err != nil {
+		return "", err
+	}
+	err := p.createThin(id, fmt.Sprintf("create_snap %d %d", id, vol.id))
+	if resumeErr := Resume(origin); resumeErr != nil {
+		err = errors.Join(err, resumeErr)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Snapshots of a clone read unprovisioned blocks from the same base image
+	return p.activate(ctx, name, thinVolume{id: id, sectors: vol.sectors, origin: vol.origin}, true)
+}
+
+// ActivateVolume creates the mapping of a thin volume already in the pool, like the ones left by a previous
+// pool that was closed. externalOrigin is the device a clone was made from, empty for other volumes.
+func (p *ThinPool) ActivateVolume(ctx context.Context, id uint32, name string, sectors uint64, externalOrigin string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.activate(ctx, name, thinVolume{id: id, sectors: sectors, origin: externalOrigin}, false)
+}
+
+// createThin sends a thin device creation message to the pool
+func (p *ThinPool) createThin(id uint32, message string) error {
+	if p.closed {
+		return fmt.Errorf("thin pool %s is closed", p.name)
+	}
+	if id > thinMaxDeviceID {
+		return fmt.Errorf("thin device id %d is larger than %d", id, thinMaxDeviceID)
+	}
+	p.log.Printf("Pool %s: %s", p.name, message)
+	return dmMessage(p.name, 0, message)
+}
+
+// activate creates the thin mapping of a volume. With isNew set the volume is deleted from the pool again
+// if the mapping cannot be created.
+func (p *ThinPool) activate(ctx context.Context, name string, vol thinVolume, isNew bool) (string, error) {
+	if p.closed {
+		return "", fmt.Errorf("thin pool %s is closed", p.name)
+	}
+	if _, ok := p.volumes[name]; ok {
+		return "", fmt.Errorf("thin volume %s already exists in pool %s", name, p.name)
+	}
+
+	// <pool dev> <dev id> [<external origin dev>]
+	params := fmt.Sprintf("%s %d", p.Path(), vol.id)
+	if vol.origin != "" {
+		params += " " + vol.origin
+	}
+	err := dmCreate(ctx, dmDevice{
+		Name:    name,
+		Targets: []Target{{Length: vol.sectors, Type: "thin", Params: params}},
+		Backing: p.name,
+	}, p.log)
+	if err != nil {
+		if isNew {
+			if delErr := dmMessage(p.name, 0, fmt.Sprintf("delete %d", vol.id)); delErr != nil {
+				p.log.Printf("%v", delErr)
+			}
+		}
+		return "", err
+	}
+
+	p.volumes[name] = vol
+	return mappingPath(name), nil
+}
+
+// DeleteVolume removes the mapping of a thin volume, along with the mappings stacked on it, and deletes the
+// volume from the pool, releasing its blocks
+func (p *ThinPool) DeleteVolume(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vol, ok := p.volumes[name]
+	if !ok {
+		return fmt.Errorf("thin volume %s not found in pool %s", name, p.name)
+	}
+	if err := removeMappingStack(name, p.log); err != nil {
+		return err
+	}
+	delete(p.volumes, name)
+
+	p.log.Printf("Pool %s: delete %d", p.name, vol.id)
+	return dmMessage(p.name, 0, fmt.Sprintf("delete %d", vol.id))
+}
+
+// Close deactivates the thin volumes and the pool and detaches the loop devices, keeping the data and metadata
+// files. Every step runs even if a previous one failed and all errors are returned. Calling Close again is a no-op.
+func (p *ThinPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var errs []error
+	for name := range p.volumes {
+		if err := removeMappingStack(name, p.log); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := removeMappingStack(p.name, p.log); err != nil {
+		errs = append(errs, err)
+	}
+
+	devices := []string{p.dataLoop, p.metaLoop}
+	for _, origin := range p.origins {
+		devices = append(devices, origin)
+	}
+	for _, dev := range devices {
+		if dev == "" {
+			continue
+		}
+		if err := Unloop(dev, p.log); err != nil {
+			errs = append(errs, fmt.Errorf("detaching %s: %w", dev, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,170 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrDeviceBusy is returned when a loop device is still in use, see DeviceBusyError
+var ErrDeviceBusy = errors.New("device is busy")
+
+// DeviceUsage lists everything that keeps a loop device busy
+type DeviceUsage struct {
+	// Holders are the device-mapper mappings stacked on the device or its partitions, top-most first
+	Holders []string
+	// Mounts are the mountpoints of the device, its partitions and its holders
+	Mounts []string
+	// Processes have the device, one of its partitions or one of its holders open
+	Processes []Process
+}
+
+// InUse reports whether anything still holds the device
+func (u *DeviceUsage) InUse() bool {
+	return len(u.Holders) > 0 || len(u.Mounts) > 0 || len(u.Processes) > 0
+}
+
+// DeviceBusyError is returned by UnloopWithOptions when the device is still in use
+type DeviceBusyError struct {
+	Device string
+	Usage  *DeviceUsage
+}
+
+func (e *DeviceBusyError) Error() string {
+	var parts []string
+	if len(e.Usage.Holders) > 0 {
+		parts = append(parts, "held by "+strings.Join(e.Usage.Holders, ", "))
+	}
+	if len(e.Usage.Mounts) > 0 {
+		parts = append(parts, "mounted on "+strings.Join(e.Usage.Mounts, ", "))
+	}
+	for _, p := range e.Usage.Processes {
+		parts = append(parts, fmt.Sprintf("open by %s (%d)", p.Command, p.PID))
+	}
+	return fmt.Sprintf("%s is busy: %s", e.Device, strings.Join(parts, "; "))
+}
+
+func (e *DeviceBusyError) Is(target error) bool {
+	return target == ErrDeviceBusy
+}
+
+// UnloopOptions controls the checks UnloopWithOptions does before detaching
+type UnloopOptions struct {
+	// Check refuses to detach a device that is still in use, returning a DeviceBusyError instead of letting
+	// the kernel fail with EBUSY or silently defer the detach
+	Check bool
+	// Cascade unmounts and removes every mapping stacked on the device before detaching it
+	Cascade bool
+}
+
+// DeviceUsers lists the mappings, mountpoints and processes using a loop device or its partitions
+func DeviceUsers(loopDevice string) (*DeviceUsage, error) {
+	dir, err := sysBlockDir(loopDevice)
+	if err != nil {
+		return nil, fmt.Errorf("device %s not found: %w", loopDevice, err)
+	}
+	name := filepath.Base(dir)
+
+	devices, err := stackedDevices(name)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &DeviceUsage{Holders: holderMappings(name)}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mounts {
+		if devices[unix.Mkdev(m.Major, m.Minor)] {
+			usage.Mounts = append(usage.Mounts, m.MountPoint)
+		}
+	}
+
+	usage.Processes = processesUsing(devices)
+
+	return usage, nil
+}
+
+// UnloopWithOptions is like UnloopContext but can check the device is unused first, or tear down what uses it
+func UnloopWithOptions(ctx context.Context, loopDevice string, opts UnloopOptions, log Logger) error {
+	if opts.Cascade {
+		if err := teardownHolders(ctx, loopDevice, log); err != nil {
+			return err
+		}
+	}
+
+	if opts.Check || opts.Cascade {
+		usage, err := DeviceUsers(loopDevice)
+		if err != nil {
+			return err
+		}
+		if usage.InUse() {
+			return &DeviceBusyError{Device: loopDevice, Usage: usage}
+		}
+	}
+
+	return UnloopContext(ctx, loopDevice, log)
+}
+
+// teardownHolders unmounts everything coming from the device and removes the mappings stacked on it, top-most first
+func teardownHolders(ctx context.Context, loopDevice string, log Logger) error {
+	if err := UnmountAll(loopDevice, log); err != nil {
+		return err
+	}
+
+	dir, err := sysBlockDir(loopDevice)
+	if err != nil {
+		return fmt.Errorf("device %s not found: %w", loopDevice, err)
+	}
+
+	var errs []error
+	for _, name := range holderMappings(filepath.Base(dir)) {
+		nodes := lookupMappingNodes(name)
+		if err := removeMappingWithRetry(ctx, name, CleanupOptions{}, log); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Removed mapping %s", name)
+		nodes.remove(log)
+		journalRemove(journalKindMapping, name, log)
+	}
+	return errors.Join(errs...)
+}
+
+// holderMappings returns the names of the mappings stacked on a block device and its partitions,
+// ordered so that each mapping comes before the ones below it
+func holderMappings(name string) []string {
+	var order []string
+	seen := map[string]bool{}
+
+	var walk func(name string)
+	walk = func(name string) {
+		dir := filepath.Join("/sys/class/block", name)
+		parts, _ := filepath.Glob(filepath.Join(dir, name+"p*"))
+		for _, p := range parts {
+			walk(filepath.Base(p))
+		}
+		holders, _ := os.ReadDir(filepath.Join(dir, "holders"))
+		for _, h := range holders {
+			if seen[h.Name()] {
+				continue
+			}
+			seen[h.Name()] = true
+			walk(h.Name())
+			dmName, err := os.ReadFile(filepath.Join("/sys/class/block", h.Name(), "dm", "name"))
+			if err == nil {
+				order = append(order, strings.TrimSpace(string(dmName)))
+			}
+		}
+	}
+	walk(name)
+
+	return order
+}
@@ -0,0 +1,317 @@
+package loopback
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	verityDefaultBlockSize = 4096
+	veritySuperblockSize   = 512
+	verityMaxSaltSize      = 256
+)
+
+// VerityPartitionTypes maps the GPT type GUIDs of verity hash partitions from the Discoverable Partitions
+// Specification to the partition they protect
+var VerityPartitionTypes = map[string]string{
+	"2c7357ed-ebd2-46d9-aec1-23d437ec2bf5": "root-x86-64-verity",
+	"df3300ce-d69f-4c92-978c-9bfb0f38d820": "root-arm64-verity",
+	"77ff5f63-e7b6-4633-acf4-1565b864c0e6": "usr-x86-64-verity",
+	"6e11a4e7-fbca-4ded-b9e9-e1a512bb664e": "usr-arm64-verity",
+}
+
+// ErrNoVerityPartition is returned when no partition has a verity hash partition type GUID
+var ErrNoVerityPartition = errors.New("no verity hash partition found")
+
+// ErrAmbiguousVerityPartition is returned when several partitions have a verity hash partition type GUID and
+// none of their UUIDs matches the root hash
+var ErrAmbiguousVerityPartition = errors.New("several verity hash partitions found and none matches the root hash")
+
+// VerityOptions describes the layout of a verity hash tree. The zero value matches the veritysetup defaults:
+// sha256 with 4096 bytes data and hash blocks and no salt.
+type VerityOptions struct {
+	HashAlgorithm string
+	DataBlockSize uint32
+	HashBlockSize uint32
+	Salt          []byte
+	// HashOffset is where the hash area starts on the hash device, in bytes. When a veritysetup superblock is
+	// found there it overrides the other options and the tree is expected right after it.
+	HashOffset uint64
+}
+
+func (o *VerityOptions) setDefaults() error {
+	if o.HashAlgorithm == "" {
+		o.HashAlgorithm = "sha256"
+	}
+	if o.DataBlockSize == 0 {
+		o.DataBlockSize = verityDefaultBlockSize
+	}
+	if o.HashBlockSize == 0 {
+		o.HashBlockSize = verityDefaultBlockSize
+	}
+	if luksHash(o.HashAlgorithm) == nil {
+		return fmt.Errorf("unsupported verity hash %s", o.HashAlgorithm)
+	}
+	for _, size := range []uint32{o.DataBlockSize, o.HashBlockSize} {
+		if size < sectorSize || !isPowerOfTwo(size) {
+			return fmt.Errorf("verity block size %d must be a power of two of at least %d", size, sectorSize)
+		}
+	}
+	if len(o.Salt) > verityMaxSaltSize {
+		return fmt.Errorf("verity salt is longer than %d bytes", verityMaxSaltSize)
+	}
+	if o.HashOffset%uint64(o.HashBlockSize) != 0 {
+		return fmt.Errorf("verity hash offset %d is not a multiple of the hash block size", o.HashOffset)
+	}
+	return nil
+}
+
+// verityLayout returns the number of hash blocks of each tree level, lowest level first
+func verityLayout(dataBlocks uint64, opts VerityOptions) (levels []uint64, digestSize int) {
+	digestSize = luksHash(opts.HashAlgorithm)().Size()
+	perBlock := uint64(opts.HashBlockSize) / uint64(verityPaddedDigest(digestSize))
+	for n := dataBlocks; n > 1; {
+		n = (n + perBlock - 1) / perBlock
+		levels = append(levels, n)
+	}
+	return levels, digestSize
+}
+
+// verityPaddedDigest is the room a digest takes in a hash block, rounded up to a power of two
+func verityPaddedDigest(size int) int {
+	padded := 1
+	for padded < size {
+		padded <<= 1
+	}
+	return padded
+}
+
+// VerityHashTreeSize returns the size in bytes of the hash tree for dataSize bytes of data, without superblock
+func VerityHashTreeSize(dataSize int64, opts VerityOptions) (int64, error) {
+	if err := opts.setDefaults(); err != nil {
+		return 0, err
+	}
+	levels, _ := verityLayout(uint64(dataSize)/uint64(opts.DataBlockSize), opts)
+	var blocks uint64
+	for _, n := range levels {
+		blocks += n
+	}
+	return int64(blocks * uint64(opts.HashBlockSize)), nil
+}
+
+// VerityHashTree computes the dm-verity hash tree of dataSize bytes of data, writes it to hashTree at
+// opts.HashOffset without a superblock and returns the root hash. It produces the same tree as
+// `veritysetup format --no-superblock`, so build pipelines do not need veritysetup.
+func VerityHashTree(data io.ReaderAt, dataSize int64, hashTree io.WriterAt, opts VerityOptions) ([]byte, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+	if dataSize <= 0 || dataSize%int64(opts.DataBlockSize) != 0 {
+		return nil, fmt.Errorf("data size %d is not a multiple of the data block size %d", dataSize, opts.DataBlockSize)
+	}
+
+	dataBlocks := uint64(dataSize) / uint64(opts.DataBlockSize)
+	levels, digestSize := verityLayout(dataBlocks, opts)
+	h := luksHash(opts.HashAlgorithm)()
+	padded := verityPaddedDigest(digestSize)
+	perBlock := int(opts.HashBlockSize) / padded
+
+	// Levels are stored top-most first, the level hashing the data blocks comes last
+	offsets := make([]uint64, len(levels))
+	position := opts.HashOffset
+	for i := len(levels) - 1; i >= 0; i-- {
+		offsets[i] = position
+		position += levels[i] * uint64(opts.HashBlockSize)
+	}
+
+	block := make([]byte, opts.DataBlockSize)
+	readBlock := func(i uint64) ([]byte, error) {
+		if _, err := data.ReadAt(block, int64(i)*int64(opts.DataBlockSize)); err != nil {
+			return nil, fmt.Errorf("reading data block %d: %w", i, err)
+		}
+		return block, nil
+	}
+	count := dataBlocks
+
+	for level, n := range levels {
+		out := make([]byte, n*uint64(opts.HashBlockSize))
+		for i := uint64(0); i < count; i++ {
+			b, err := readBlock(i)
+			if err != nil {
+				return nil, err
+			}
+			verityDigest(h, opts.Salt, b, out[int(i)/perBlock*int(opts.HashBlockSize)+int(i)%perBlock*padded:])
+		}
+		if _, err := hashTree.WriteAt(out, int64(offsets[level])); err != nil {
+			return nil, fmt.Errorf("writing verity level %d: %w", level, err)
+		}
+
+		// The next level hashes the blocks of this one
+		levelData := out
+		readBlock = func(i uint64) ([]byte, error) {
+			return levelData[i*uint64(opts.HashBlockSize) : (i+1)*uint64(opts.HashBlockSize)], nil
+		}
+		count = n
+	}
+
+	b, err := readBlock(0)
+	if err != nil {
+		return nil, err
+	}
+	root := make([]byte, digestSize)
+	verityDigest(h, opts.Salt, b, root)
+	return root, nil
+}
+
+// verityDigest hashes a block the way version 1 of the verity format does, salt first
+func verityDigest(h hash.Hash, salt, block, dst []byte) {
+	h.Reset()
+	h.Write(salt)
+	h.Write(block)
+	copy(dst, h.Sum(nil))
+}
+
+// readVeritySuperblock fills opts from a veritysetup superblock at opts.HashOffset and returns the number of
+// data blocks it records. It returns false when there is no superblock.
+func readVeritySuperblock(r io.ReaderAt, opts *VerityOptions) (uint64, bool, error) {
+	sb := make([]byte, veritySuperblockSize)
+	if _, err := r.ReadAt(sb, int64(opts.HashOffset)); err != nil {
+		return 0, false, fmt.Errorf("reading verity superblock: %w", err)
+	}
+	if !bytes.Equal(sb[:8], []byte("verity\x00\x00")) {
+		return 0, false, nil
+	}
+	if version := binary.LittleEndian.Uint32(sb[8:12]); version != 1 {
+		return 0, false, fmt.Errorf("unsupported verity superblock version %d", version)
+	}
+	if hashType := binary.LittleEndian.Uint32(sb[12:16]); hashType != 1 {
+		return 0, false, fmt.Errorf("unsupported verity hash type %d", hashType)
+	}
+	saltSize := binary.LittleEndian.Uint16(sb[80:82])
+	if saltSize > verityMaxSaltSize {
+		return 0, false, fmt.Errorf("verity salt size %d out of range", saltSize)
+	}
+
+	opts.HashAlgorithm = cString(sb[32:64])
+	opts.DataBlockSize = binary.LittleEndian.Uint32(sb[64:68])
+	opts.HashBlockSize = binary.LittleEndian.Uint32(sb[68:72])
+	opts.Salt = append([]byte(nil), sb[88:88+int(saltSize)]...)
+	return binary.LittleEndian.Uint64(sb[72:80]), true, nil
+}
+
+// OpenVerity creates a read-only verity mapping called name that checks every read from dataDevice against the
+// hash tree on hashDevice and rootHash. It returns the path of the verified device.
+func OpenVerity(ctx context.Context, dataDevice, hashDevice, name string, rootHash []byte, opts VerityOptions, log Logger) (string, error) {
+	hashFile, err := os.Open(hashDevice)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", hashDevice, err)
+	}
+	defer hashFile.Close()
+
+	dataBlocks, hasSuperblock, err := readVeritySuperblock(hashFile, &opts)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", hashDevice, err)
+	}
+	if err := opts.setDefaults(); err != nil {
+		return "", err
+	}
+
+	hashStart := opts.HashOffset / uint64(opts.HashBlockSize)
+	if hasSuperblock {
+		hashStart = (opts.HashOffset + veritySuperblockSize + uint64(opts.HashBlockSize) - 1) / uint64(opts.HashBlockSize)
+	} else {
+		dataFile, err := os.Open(dataDevice)
+		if err != nil {
+			return "", fmt.Errorf("open %s: %w", dataDevice, err)
+		}
+		size, err := dataFile.Seek(0, io.SeekEnd)
+		dataFile.Close()
+		if err != nil {
+			return "", fmt.Errorf("getting size of %s: %w", dataDevice, err)
+		}
+		dataBlocks = uint64(size) / uint64(opts.DataBlockSize)
+	}
+	if dataBlocks == 0 {
+		return "", fmt.Errorf("%s has no data blocks", dataDevice)
+	}
+
+	if _, digestSize := verityLayout(dataBlocks, opts); len(rootHash) != digestSize {
+		return "", fmt.Errorf("root hash is %d bytes, %s needs %d", len(rootHash), opts.HashAlgorithm, digestSize)
+	}
+
+	salt := "-"
+	if len(opts.Salt) > 0 {
+		salt = hex.EncodeToString(opts.Salt)
+	}
+	// <version> <data_dev> <hash_dev> <data_block_size> <hash_block_size> <num_data_blocks> <hash_start_block>
+	// <algorithm> <digest> <salt>
+	params := fmt.Sprintf("1 %s %s %d %d %d %d %s %s %s", dataDevice, hashDevice, opts.DataBlockSize, opts.HashBlockSize,
+		dataBlocks, hashStart, strings.ToLower(opts.HashAlgorithm), hex.EncodeToString(rootHash), salt)
+
+	log.Printf("Creating verity mapping %s on %s", name, dataDevice)
+	err = dmCreate(ctx, dmDevice{
+		Name:     name,
+		Targets:  []Target{{Length: dataBlocks * uint64(opts.DataBlockSize) / sectorSize, Type: "verity", Params: params}},
+		ReadOnly: true,
+		Backing:  dataDevice,
+	}, log)
+	if err != nil {
+		return "", err
+	}
+
+	return mappingPath(name), nil
+}
+
+// FindVerityPartition returns the verity hash partition among partitions. When several are present the one
+// whose UUID matches the last 128 bits of rootHash is picked, as the Discoverable Partitions Specification
+// suggests, and ErrAmbiguousVerityPartition is returned if there is none.
+func FindVerityPartition(partitions []Partition, rootHash []byte) (*Partition, error) {
+	var found []*Partition
+	for i := range partitions {
+		if _, ok := VerityPartitionTypes[partitions[i].TypeGUID]; ok {
+			found = append(found, &partitions[i])
+		}
+	}
+	if len(found) == 0 {
+		return nil, ErrNoVerityPartition
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	if len(rootHash) >= 16 {
+		tail := rootHash[len(rootHash)-16:]
+		uuid := fmt.Sprintf("%x-%x-%x-%x-%x", tail[0:4], tail[4:6], tail[6:8], tail[8:10], tail[10:16])
+		for _, p := range found {
+			if p.UUID == uuid {
+				return p, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w (%d candidates)", ErrAmbiguousVerityPartition, len(found))
+}
+
+// OpenVerity creates a verity mapping called name for the given data partition, using the verity hash partition
+// of the image found by its GPT type GUID
+func (i *Image) OpenVerity(ctx context.Context, number int, name string, rootHash []byte, opts VerityOptions) (string, error) {
+	dataDevice, err := i.PartitionPath(number)
+	if err != nil {
+		return "", err
+	}
+	hashPartition, err := FindVerityPartition(i.partitions, rootHash)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", i.path, err)
+	}
+	hashDevice, err := i.PartitionPath(hashPartition.Number)
+	if err != nil {
+		return "", err
+	}
+	return OpenVerity(ctx, dataDevice, hashDevice, name, rootHash, opts, i.log)
+}
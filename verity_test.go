@@ -0,0 +1,149 @@
+package loopback
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+type bufferAt struct{ b []byte }
+
+func (w *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(w.b) {
+		w.b = append(w.b, make([]byte, end-len(w.b))...)
+	}
+	return copy(w.b[off:], p), nil
+}
+
+func TestVerityHashTree(t *testing.T) {
+	opts := VerityOptions{DataBlockSize: 512, HashBlockSize: 512, Salt: []byte("salt")}
+	data := make([]byte, 40*512)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+
+	tree := &bufferAt{}
+	root, err := VerityHashTree(bytes.NewReader(data), int64(len(data)), tree, opts)
+	if err != nil {
+		t.Fatalf("VerityHashTree: %v", err)
+	}
+
+	// 16 sha256 digests fit in a 512 bytes block: 40 data blocks need 3 hash blocks, hashed by a single top block
+	// stored first
+	digest := func(b []byte) []byte {
+		sum := sha256.Sum256(append([]byte("salt"), b...))
+		return sum[:]
+	}
+	level0 := make([]byte, 3*512)
+	for i := 0; i < 40; i++ {
+		copy(level0[i*32:], digest(data[i*512:(i+1)*512]))
+	}
+	level1 := make([]byte, 512)
+	for i := 0; i < 3; i++ {
+		copy(level1[i*32:], digest(level0[i*512:(i+1)*512]))
+	}
+
+	if want := append(append([]byte{}, level1...), level0...); !bytes.Equal(tree.b, want) {
+		t.Errorf("unexpected hash tree layout")
+	}
+	if !bytes.Equal(root, digest(level1)) {
+		t.Errorf("root hash %x, want %x", root, digest(level1))
+	}
+	if size, err := VerityHashTreeSize(int64(len(data)), opts); err != nil || size != int64(len(tree.b)) {
+		t.Errorf("VerityHashTreeSize = %d, %v, want %d", size, err, len(tree.b))
+	}
+}
+
+// The expected values come from `veritysetup format --no-superblock --salt 73616c74 --hash <hash>
+// --data-block-size <size> --hash-block-size <size>` (cryptsetup 2.6.1) on the same data, the hash tree is given
+// by its sha256
+func TestVerityHashTreeKnownAnswer(t *testing.T) {
+	for _, tc := range []struct {
+		hash      string
+		blockSize uint32
+		blocks    int
+		root      string
+		tree      string
+		treeSize  int
+	}{
+		{"sha256", 512, 40, "96a8dc15ef37958569bd0323a897022cea692b34765069bcf350acac373c4392",
+			"2fa3d8f4f1ba2b688e418821bef377412a936cf67aa88a83d692402357351069", 2048},
+		{"sha512", 4096, 300, "ecaf87ce551ff1d01810085e04cd86b28f1679c98eba9d5e6c5eef9d5d82fa65c9e9b30cbde17dd6b6e54e3affcd074490a43e4de0d48d869c4114b1eb7654bf",
+			"57b382c91c5183af865c262be9f7146ce25feeabd452d148a1bcb1e837688ec3", 24576},
+	} {
+		data := make([]byte, tc.blocks*int(tc.blockSize))
+		for i := range data {
+			data[i] = byte(i / int(tc.blockSize))
+		}
+		opts := VerityOptions{HashAlgorithm: tc.hash, DataBlockSize: tc.blockSize, HashBlockSize: tc.blockSize, Salt: []byte("salt")}
+		tree := &bufferAt{}
+		root, err := VerityHashTree(bytes.NewReader(data), int64(len(data)), tree, opts)
+		if err != nil {
+			t.Fatalf("%s: VerityHashTree: %v", tc.hash, err)
+		}
+		if got := hex.EncodeToString(root); got != tc.root {
+			t.Errorf("%s: root hash %s, want %s", tc.hash, got, tc.root)
+		}
+		if sum := sha256.Sum256(tree.b); len(tree.b) != tc.treeSize || hex.EncodeToString(sum[:]) != tc.tree {
+			t.Errorf("%s: hash tree of %d bytes differs from veritysetup", tc.hash, len(tree.b))
+		}
+	}
+}
+
+func TestReadVeritySuperblock(t *testing.T) {
+	sb := make([]byte, 4096)
+	copy(sb, "verity\x00\x00")
+	binary.LittleEndian.PutUint32(sb[8:], 1)
+	binary.LittleEndian.PutUint32(sb[12:], 1)
+	copy(sb[32:], "sha512")
+	binary.LittleEndian.PutUint32(sb[64:], 4096)
+	binary.LittleEndian.PutUint32(sb[68:], 1024)
+	binary.LittleEndian.PutUint64(sb[72:], 300)
+	binary.LittleEndian.PutUint16(sb[80:], 2)
+	copy(sb[88:], []byte{0xbe, 0xef})
+
+	var opts VerityOptions
+	blocks, ok, err := readVeritySuperblock(bytes.NewReader(sb), &opts)
+	if err != nil || !ok {
+		t.Fatalf("readVeritySuperblock: %v, %v", ok, err)
+	}
+	if blocks != 300 || opts.HashAlgorithm != "sha512" || opts.HashBlockSize != 1024 || !bytes.Equal(opts.Salt, []byte{0xbe, 0xef}) {
+		t.Errorf("unexpected superblock %d %+v", blocks, opts)
+	}
+
+	if _, ok, err := readVeritySuperblock(bytes.NewReader(make([]byte, 4096)), &VerityOptions{}); ok || err != nil {
+		t.Errorf("expected no superblock, got %v, %v", ok, err)
+	}
+}
+
+func TestFindVerityPartition(t *testing.T) {
+	root := bytes.Repeat([]byte{0x11}, 16)
+	root = append(root, 0xaa, 0xbb, 0xcc, 0xdd, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	parts := []Partition{
+		{Number: 1, TypeGUID: "4f68bce3-e8cd-4db1-96e7-fbcaf984b709"},
+		{Number: 2, TypeGUID: "2c7357ed-ebd2-46d9-aec1-23d437ec2bf5", UUID: "01234567-89ab-cdef-0123-456789abcdef"},
+		{Number: 3, TypeGUID: "2c7357ed-ebd2-46d9-aec1-23d437ec2bf5", UUID: "aabbccdd-0001-0203-0405-060708090a0b"},
+	}
+
+	p, err := FindVerityPartition(parts, root)
+	if err != nil || p.Number != 3 {
+		t.Fatalf("FindVerityPartition = %+v, %v, want partition 3", p, err)
+	}
+	if _, err := FindVerityPartition(parts[:1], root); !errors.Is(err, ErrNoVerityPartition) {
+		t.Errorf("got %v, want ErrNoVerityPartition", err)
+	}
+
+	// Without a matching UUID there is no telling which hash partition to use
+	if _, err := FindVerityPartition(parts, bytes.Repeat([]byte{0x22}, 32)); !errors.Is(err, ErrAmbiguousVerityPartition) {
+		t.Errorf("got %v, want ErrAmbiguousVerityPartition", err)
+	}
+	if _, err := FindVerityPartition(parts, nil); !errors.Is(err, ErrAmbiguousVerityPartition) {
+		t.Errorf("got %v, want ErrAmbiguousVerityPartition", err)
+	}
+	if p, err := FindVerityPartition(parts[:2], nil); err != nil || p.Number != 2 {
+		t.Errorf("FindVerityPartition = %+v, %v, want partition 2", p, err)
+	}
+}
@@ -0,0 +1,110 @@
+package loopback
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	vhdCookie        = "conectix"
+	vhdFooterSize    = 512
+	vhdDynamicCookie = "cxsparse"
+	vhdDynamicSize   = 1024
+	// vhdMaxTableEntries bounds the block allocation table to 16MiB
+	vhdMaxTableEntries = 4 << 20
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+
+	vhdUnallocated = 0xffffffff
+)
+
+// openVHD reads the footer of a fixed or dynamic VHD (Virtual PC / Hyper-V) image, differencing disks are not
+// supported as they need their parent
+func openVHD(f *os.File, size int64) (Disk, error) {
+	footer := make([]byte, vhdFooterSize)
+	if _, err := f.ReadAt(footer, size-vhdFooterSize); err != nil {
+		return nil, fmt.Errorf("reading VHD footer: %w", err)
+	}
+	if !vhdChecksumValid(footer, 64) {
+		return nil, fmt.Errorf("%w: VHD footer checksum mismatch", ErrInvalidDiskImage)
+	}
+
+	diskSize := int64(binary.BigEndian.Uint64(footer[48:56]))
+	switch diskType := binary.BigEndian.Uint32(footer[60:64]); diskType {
+	case vhdTypeFixed:
+		if diskSize < 0 || diskSize > size-vhdFooterSize {
+			return nil, fmt.Errorf("%w: VHD disk size %d exceeds the file size %d", ErrInvalidDiskImage, diskSize, size)
+		}
+		return &blockDisk{File: f, size: diskSize, blockSize: max(diskSize, 1), lookup: func(int64) (int64, error) {
+			return 0, nil
+		}}, nil
+	case vhdTypeDynamic:
+		return openDynamicVHD(f, size, diskSize, int64(binary.BigEndian.Uint64(footer[16:24])))
+	case vhdTypeDifferencing:
+		return nil, fmt.Errorf("%w: differencing VHD", ErrInvalidDiskImage)
+	default:
+		return nil, fmt.Errorf("%w: unknown VHD disk type %d", ErrInvalidDiskImage, diskType)
+	}
+}
+
+// openDynamicVHD reads the dynamic disk header and the block allocation table, each allocated block is a
+// sector bitmap followed by the block data
+func openDynamicVHD(f *os.File, size, diskSize, headerOffset int64) (Disk, error) {
+	if headerOffset < 0 || headerOffset > size-vhdDynamicSize {
+		return nil, fmt.Errorf("%w: VHD dynamic header offset %d is outside the file", ErrInvalidDiskImage, headerOffset)
+	}
+	hdr := make([]byte, vhdDynamicSize)
+	if _, err := f.ReadAt(hdr, headerOffset); err != nil {
+		return nil, fmt.Errorf("reading VHD dynamic header: %w", err)
+	}
+	if string(hdr[:8]) != vhdDynamicCookie || !vhdChecksumValid(hdr, 36) {
+		return nil, fmt.Errorf("%w: bad VHD dynamic header", ErrInvalidDiskImage)
+	}
+
+	tableOffset := int64(binary.BigEndian.Uint64(hdr[16:24]))
+	entries := int64(binary.BigEndian.Uint32(hdr[28:32]))
+	blockSize := int64(binary.BigEndian.Uint32(hdr[32:36]))
+	if blockSize < sectorSize || blockSize%sectorSize != 0 || !isPowerOfTwo(uint32(blockSize)) {
+		return nil, fmt.Errorf("%w: VHD block size %d", ErrInvalidDiskImage, blockSize)
+	}
+	if entries > vhdMaxTableEntries || diskSize < 0 || diskSize > entries*blockSize {
+		return nil, fmt.Errorf("%w: VHD table of %d blocks of %d bytes for a %d bytes disk",
+			ErrInvalidDiskImage, entries, blockSize, diskSize)
+	}
+	if tableOffset < 0 || tableOffset > size-entries*4 {
+		return nil, fmt.Errorf("%w: VHD block table at %d is outside the file", ErrInvalidDiskImage, tableOffset)
+	}
+
+	raw := make([]byte, entries*4)
+	if _, err := f.ReadAt(raw, tableOffset); err != nil {
+		return nil, fmt.Errorf("reading VHD block table: %w", err)
+	}
+	table := make([]uint32, entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+
+	// The sector bitmap has one bit per sector, padded to a whole sector
+	bitmapSize := (blockSize/sectorSize/8 + sectorSize - 1) / sectorSize * sectorSize
+	return &blockDisk{File: f, size: diskSize, blockSize: blockSize, lookup: func(block int64) (int64, error) {
+		// Like qemu, the sector bitmap of an allocated block is not consulted, unwritten sectors are zeroes
+		if table[block] == vhdUnallocated {
+			return -1, nil
+		}
+		return int64(table[block])*sectorSize + bitmapSize, nil
+	}}, nil
+}
+
+// vhdChecksumValid checks the one's complement of the sum of all bytes but the checksum itself, at off
+func vhdChecksumValid(b []byte, off int) bool {
+	var sum uint32
+	for i, c := range b {
+		if i < off || i >= off+4 {
+			sum += uint32(c)
+		}
+	}
+	return ^sum == binary.BigEndian.Uint32(b[off:])
+}
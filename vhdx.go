@@ -0,0 +1,211 @@
+package loopback
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const (
+	vhdxSignature       = "vhdxfile"
+	vhdxHeaderSize      = 4 << 10
+	vhdxRegionTableSize = 64 << 10
+	// vhdxMaxRegionEntries and vhdxMaxMetadataEntries are the limits set by the spec
+	vhdxMaxRegionEntries   = 2047
+	vhdxMaxMetadataEntries = 2047
+	// vhdxMaxBATSize bounds the block allocation table to 256MiB
+	vhdxMaxBATSize = 256 << 20
+	// vhdxMaxMetadataSize bounds the metadata region, images made by Hyper-V and qemu-img use 1MiB
+	vhdxMaxMetadataSize = 4 << 20
+
+	vhdxRegionBAT      = "2dc27766-f623-4200-9d64-115e9bfd4a08"
+	vhdxRegionMetadata = "8b7ca206-4790-4b9a-b8fe-575f050f886e"
+
+	vhdxMetaFileParameters    = "caa16737-fa36-4d43-b3b6-33f0aa44e76b"
+	vhdxMetaVirtualDiskSize   = "2fa54224-cd1b-4876-b211-5dbed83bf4b8"
+	vhdxMetaLogicalSectorSize = "8141bf1d-a96f-4709-ba47-f233a8faab5f"
+
+	vhdxFileHasParent = 1 << 1
+
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+	vhdxBlockStateMask        = 7
+	vhdxOffsetMask            = ^uint64(1<<20 - 1)
+)
+
+var vhdxCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// openVHDX reads the headers, region table and metadata of a VHDX image. Differencing disks and images with
+// a log left to replay are not supported.
+func openVHDX(f *os.File, size int64) (Disk, error) {
+	if err := checkVHDXHeaders(f); err != nil {
+		return nil, err
+	}
+
+	regions, err := readVHDXRegions(f)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := regions[vhdxRegionMetadata]
+	if !ok {
+		return nil, fmt.Errorf("%w: VHDX has no metadata region", ErrInvalidDiskImage)
+	}
+	bat, ok := regions[vhdxRegionBAT]
+	if !ok {
+		return nil, fmt.Errorf("%w: VHDX has no block allocation table region", ErrInvalidDiskImage)
+	}
+
+	items, err := readVHDXMetadata(f, meta[0], meta[1], size)
+	if err != nil {
+		return nil, err
+	}
+	params, diskSizeItem, sectorItem := items[vhdxMetaFileParameters], items[vhdxMetaVirtualDiskSize], items[vhdxMetaLogicalSectorSize]
+	if len(params) < 8 || len(diskSizeItem) < 8 || len(sectorItem) < 4 {
+		return nil, fmt.Errorf("%w: VHDX is missing required metadata", ErrInvalidDiskImage)
+	}
+	blockSize := int64(binary.LittleEndian.Uint32(params[0:4]))
+	if binary.LittleEndian.Uint32(params[4:8])&vhdxFileHasParent != 0 {
+		return nil, fmt.Errorf("%w: differencing VHDX", ErrInvalidDiskImage)
+	}
+	diskSize := int64(binary.LittleEndian.Uint64(diskSizeItem))
+	logicalSectorSize := int64(binary.LittleEndian.Uint32(sectorItem))
+	if blockSize < 1<<20 || blockSize > 256<<20 || !isPowerOfTwo(uint32(blockSize)) {
+		return nil, fmt.Errorf("%w: VHDX block size %d", ErrInvalidDiskImage, blockSize)
+	}
+	if logicalSectorSize != 512 && logicalSectorSize != 4096 {
+		return nil, fmt.Errorf("%w: VHDX logical sector size %d", ErrInvalidDiskImage, logicalSectorSize)
+	}
+	if diskSize < 0 || diskSize > 64<<40 {
+		return nil, fmt.Errorf("%w: VHDX disk size %d", ErrInvalidDiskImage, diskSize)
+	}
+
+	// A sector bitmap entry follows every chunkRatio payload blocks in the table
+	chunkRatio := (1 << 23) * logicalSectorSize / blockSize
+	blocks := (diskSize + blockSize - 1) / blockSize
+	entries := blocks + (blocks-1)/chunkRatio
+	if entries*8 > int64(bat[1]) || entries*8 > vhdxMaxBATSize {
+		return nil, fmt.Errorf("%w: VHDX block allocation table of %d bytes is too small for %d blocks",
+			ErrInvalidDiskImage, bat[1], blocks)
+	}
+	if bat[0] > uint64(size) || uint64(entries*8) > uint64(size)-bat[0] {
+		return nil, fmt.Errorf("%w: VHDX block allocation table at %d is outside the file", ErrInvalidDiskImage, bat[0])
+	}
+	raw := make([]byte, max(entries, 0)*8)
+	if _, err := f.ReadAt(raw, int64(bat[0])); err != nil {
+		return nil, fmt.Errorf("reading VHDX block allocation table: %w", err)
+	}
+
+	return &blockDisk{File: f, size: diskSize, blockSize: blockSize, lookup: func(block int64) (int64, error) {
+		entry := binary.LittleEndian.Uint64(raw[(block+block/chunkRatio)*8:])
+		switch entry & vhdxBlockStateMask {
+		case vhdxBlockFullyPresent:
+			offset := int64(entry & vhdxOffsetMask)
+			if offset+blockSize > size {
+				return 0, fmt.Errorf("%w: VHDX block %d at %d is outside the file", ErrInvalidDiskImage, block, offset)
+			}
+			return offset, nil
+		case vhdxBlockPartiallyPresent:
+			return 0, fmt.Errorf("%w: VHDX block %d is partially present", ErrInvalidDiskImage, block)
+		default:
+			// Not present, undefined, zero and unmapped blocks all read as zeroes
+			return -1, nil
+		}
+	}}, nil
+}
+
+// checkVHDXHeaders picks the current one of the two headers and makes sure it has no log to replay
+func checkVHDXHeaders(f *os.File) error {
+	var current []byte
+	var sequence uint64
+	for _, off := range []int64{64 << 10, 128 << 10} {
+		hdr := make([]byte, vhdxHeaderSize)
+		if _, err := f.ReadAt(hdr, off); err != nil {
+			continue
+		}
+		if string(hdr[:4]) != "head" || !vhdxChecksumValid(hdr) {
+			continue
+		}
+		if seq := binary.LittleEndian.Uint64(hdr[8:16]); current == nil || seq > sequence {
+			current, sequence = hdr, seq
+		}
+	}
+	if current == nil {
+		return fmt.Errorf("%w: no valid VHDX header", ErrInvalidDiskImage)
+	}
+	for _, b := range current[48:64] {
+		if b != 0 {
+			return fmt.Errorf("%w: VHDX log needs to be replayed", ErrInvalidDiskImage)
+		}
+	}
+	return nil
+}
+
+// readVHDXRegions returns the file offset and length of each region, by GUID
+func readVHDXRegions(f *os.File) (map[string][2]uint64, error) {
+	for _, off := range []int64{192 << 10, 256 << 10} {
+		table := make([]byte, vhdxRegionTableSize)
+		if _, err := f.ReadAt(table, off); err != nil {
+			continue
+		}
+		if string(table[:4]) != "regi" || !vhdxChecksumValid(table) {
+			continue
+		}
+		count := binary.LittleEndian.Uint32(table[8:12])
+		if count > vhdxMaxRegionEntries {
+			return nil, fmt.Errorf("%w: %d VHDX regions", ErrInvalidDiskImage, count)
+		}
+		regions := make(map[string][2]uint64, count)
+		for i := range int(count) {
+			entry := table[16+i*32 : 16+(i+1)*32]
+			regions[formatGUID(entry[0:16])] = [2]uint64{
+				binary.LittleEndian.Uint64(entry[16:24]),
+				uint64(binary.LittleEndian.Uint32(entry[24:28])),
+			}
+		}
+		return regions, nil
+	}
+	return nil, fmt.Errorf("%w: no valid VHDX region table", ErrInvalidDiskImage)
+}
+
+// readVHDXMetadata returns the metadata items of the region at offset, by GUID. size is the size of the image,
+// the region has to fit in it.
+func readVHDXMetadata(f *os.File, offset, length uint64, size int64) (map[string][]byte, error) {
+	if length < 64<<10 || length > vhdxMaxMetadataSize {
+		return nil, fmt.Errorf("%w: VHDX metadata region of %d bytes", ErrInvalidDiskImage, length)
+	}
+	if offset > uint64(size) || length > uint64(size)-offset {
+		return nil, fmt.Errorf("%w: VHDX metadata region at %d is outside the file", ErrInvalidDiskImage, offset)
+	}
+	region := make([]byte, length)
+	if _, err := f.ReadAt(region, int64(offset)); err != nil {
+		return nil, fmt.Errorf("reading VHDX metadata: %w", err)
+	}
+	if string(region[:8]) != "metadata" {
+		return nil, fmt.Errorf("%w: bad VHDX metadata signature", ErrInvalidDiskImage)
+	}
+	count := int(binary.LittleEndian.Uint16(region[10:12]))
+	if count > vhdxMaxMetadataEntries {
+		return nil, fmt.Errorf("%w: %d VHDX metadata entries", ErrInvalidDiskImage, count)
+	}
+
+	items := make(map[string][]byte, count)
+	for i := range count {
+		entry := region[32+i*32 : 32+(i+1)*32]
+		off := uint64(binary.LittleEndian.Uint32(entry[16:20]))
+		n := uint64(binary.LittleEndian.Uint32(entry[20:24]))
+		if off+n > length {
+			return nil, fmt.Errorf("%w: VHDX metadata item %s is outside its region", ErrInvalidDiskImage, formatGUID(entry[0:16]))
+		}
+		items[formatGUID(entry[0:16])] = region[off : off+n]
+	}
+	return items, nil
+}
+
+// vhdxChecksumValid checks the CRC-32C of a header or region table, computed with its checksum field zeroed
+func vhdxChecksumValid(b []byte) bool {
+	want := binary.LittleEndian.Uint32(b[4:8])
+	crc := crc32.Update(0, vhdxCRC, b[:4])
+	crc = crc32.Update(crc, vhdxCRC, make([]byte, 4))
+	return crc32.Update(crc, vhdxCRC, b[8:]) == want
+}
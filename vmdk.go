@@ -0,0 +1,88 @@
+package loopback
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	vmdkMagic      = "KDMV"
+	vmdkHeaderSize = 79
+	// vmdkMaxGrainTables bounds the grain directory to 4MiB
+	vmdkMaxGrainTables = 1 << 20
+
+	vmdkFlagCompressed = 1 << 16
+	vmdkGDAtEnd        = 0xffffffffffffffff
+	// vmdkGrainZero marks a grain table entry as a zeroed grain
+	vmdkGrainZero = 1
+)
+
+// openVMDK reads the header and grain directory of a monolithic sparse VMDK extent. Stream-optimized
+// (compressed) extents are not supported.
+func openVMDK(f *os.File, size int64) (Disk, error) {
+	hdr := make([]byte, vmdkHeaderSize)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("reading VMDK header: %w", err)
+	}
+	version := binary.LittleEndian.Uint32(hdr[4:8])
+	flags := binary.LittleEndian.Uint32(hdr[8:12])
+	capacity := binary.LittleEndian.Uint64(hdr[12:20])
+	grainSectors := binary.LittleEndian.Uint64(hdr[20:28])
+	gtEntries := uint64(binary.LittleEndian.Uint32(hdr[44:48]))
+	gdOffset := binary.LittleEndian.Uint64(hdr[56:64])
+
+	if version < 1 || version > 3 {
+		return nil, fmt.Errorf("%w: VMDK version %d", ErrInvalidDiskImage, version)
+	}
+	if flags&vmdkFlagCompressed != 0 || gdOffset == vmdkGDAtEnd {
+		return nil, fmt.Errorf("%w: stream-optimized VMDK", ErrInvalidDiskImage)
+	}
+	if grainSectors < 8 || grainSectors > 1<<16 || !isPowerOfTwo(uint32(grainSectors)) {
+		return nil, fmt.Errorf("%w: VMDK grain of %d sectors", ErrInvalidDiskImage, grainSectors)
+	}
+	if gtEntries == 0 || gtEntries > 1<<16 {
+		return nil, fmt.Errorf("%w: %d VMDK grain table entries", ErrInvalidDiskImage, gtEntries)
+	}
+	if capacity > 1<<(63-9) {
+		return nil, fmt.Errorf("%w: VMDK capacity of %d sectors", ErrInvalidDiskImage, capacity)
+	}
+
+	grainSize := int64(grainSectors * sectorSize)
+	grains := (capacity + grainSectors - 1) / grainSectors
+	tables := (grains + gtEntries - 1) / gtEntries
+	if tables > vmdkMaxGrainTables || gdOffset > uint64(size)/sectorSize {
+		return nil, fmt.Errorf("%w: VMDK grain directory of %d tables at sector %d", ErrInvalidDiskImage, tables, gdOffset)
+	}
+	gd := make([]byte, tables*4)
+	if _, err := f.ReadAt(gd, int64(gdOffset*sectorSize)); err != nil {
+		return nil, fmt.Errorf("reading VMDK grain directory: %w", err)
+	}
+
+	// Grain tables are read on first use, 4 bytes per grain they add up to 2MiB per GiB of 64KiB grains
+	gts := make([][]uint32, tables)
+	return &blockDisk{File: f, size: int64(capacity * sectorSize), blockSize: grainSize, lookup: func(grain int64) (int64, error) {
+		table, index := uint64(grain)/gtEntries, uint64(grain)%gtEntries
+		gtSector := binary.LittleEndian.Uint32(gd[table*4:])
+		if gtSector == 0 {
+			return -1, nil
+		}
+		if gts[table] == nil {
+			raw := make([]byte, gtEntries*4)
+			if _, err := f.ReadAt(raw, int64(gtSector)*sectorSize); err != nil {
+				return 0, fmt.Errorf("reading VMDK grain table %d: %w", table, err)
+			}
+			gt := make([]uint32, gtEntries)
+			for i := range gt {
+				gt[i] = binary.LittleEndian.Uint32(raw[i*4:])
+			}
+			gts[table] = gt
+		}
+		switch sector := gts[table][index]; sector {
+		case 0, vmdkGrainZero:
+			return -1, nil
+		default:
+			return int64(sector) * sectorSize, nil
+		}
+	}}, nil
+}
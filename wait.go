@@ -0,0 +1,32 @@
+package loopback
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// deviceWaitTimeout bounds how long we wait for a device node when the caller did not set a deadline
+	deviceWaitTimeout = 5 * time.Second
+	// devicePollInterval is how often we check for a device node to show up
+	devicePollInterval = 50 * time.Millisecond
+)
+
+// WaitForDevice waits until the device node at path exists, or returns the context error once ctx is done
+func WaitForDevice(ctx context.Context, path string) error {
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %s: %w", path, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
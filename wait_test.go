@@ -0,0 +1,31 @@
+package loopback
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaitForDevice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop0p1")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(path, nil, 0o600)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitForDevice(ctx, path); err != nil {
+		t.Fatalf("WaitForDevice() failed: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := WaitForDevice(ctx, path+"-missing")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+}